@@ -0,0 +1,170 @@
+package fusion
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Proc = (*Batch)(nil)
+
+// Batch implements a concurrent Proc that accumulates messages into batches
+// and hands them to a batch handler. A batch is handed over when it has Size
+// messages or when Timeout elapses after the first message of the batch was
+// received, whichever happens first.
+type Batch struct {
+	// Number of worker threads to launch for accumulating and processing
+	// batches. If not set, defaults to 1.
+	Workers int
+
+	// Size is the maximum number of messages in a batch. Timeout is the
+	// maximum time to wait for a batch to fill up. Defaults to 100 messages
+	// and 100ms.
+	Size    int
+	Timeout time.Duration
+
+	// Func is invoked for each batch. All messages in the batch are acked
+	// with the returned error.
+	Func func(ctx context.Context, batch []Msg) error
+
+	// ItemsFunc can be set instead of Func to acknowledge messages of the
+	// batch individually. It must return one error per message (or a nil
+	// slice if all succeeded) and messages are acked with the error at the
+	// same index. If both are set, ItemsFunc is used.
+	ItemsFunc func(ctx context.Context, batch []Msg) []error
+}
+
+// Run spawns the configured number of worker threads.
+func (b *Batch) Run(ctx context.Context, stream <-chan Msg) error {
+	log := LogFrom(ctx)
+	b.init()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < b.Workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+
+			for {
+				batch, open := b.nextBatch(ctx, stream)
+				if len(batch) > 0 {
+					b.process(ctx, batch)
+				}
+
+				if !open {
+					log.Infof("batch worker %d exiting", id)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	log.Infof("all batch workers exited")
+	return nil
+}
+
+// nextBatch blocks for the first message and then collects messages until
+// the batch is full or the timeout elapses. Returns false when the stream
+// is closed or ctx is cancelled. If ctx is cancelled, the partial batch is
+// nAcked with Retry instead of being returned.
+func (b *Batch) nextBatch(ctx context.Context, stream <-chan Msg) ([]Msg, bool) {
+	var batch []Msg
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case msg, open := <-stream:
+		if !open {
+			return nil, false
+		}
+		batch = append(make([]Msg, 0, b.Size), msg)
+	}
+
+	timeout := time.NewTimer(b.Timeout)
+	defer timeout.Stop()
+
+	for len(batch) < b.Size {
+		select {
+		case <-ctx.Done():
+			for _, msg := range batch {
+				msg.Ack(Retry)
+			}
+			return nil, false
+		case <-timeout.C:
+			return batch, true
+		case msg, open := <-stream:
+			if !open {
+				return batch, false
+			}
+			batch = append(batch, msg)
+		}
+	}
+	return batch, true
+}
+
+func (b *Batch) process(ctx context.Context, batch []Msg) {
+	metrics := MetricsFrom(ctx)
+
+	start := time.Now()
+	errs := b.invoke(ctx, batch)
+	metrics.Observe("fusion_batch_size", float64(len(batch)), nil)
+	metrics.Observe("fusion_batch_duration_seconds", time.Since(start).Seconds(), nil)
+
+	for i, msg := range batch {
+		metrics.Count("fusion_batch_results_total", 1, map[string]string{"result": ResultLabel(errs[i])})
+		msg.Ack(errs[i])
+	}
+}
+
+// invoke calls the batch handler and returns the ack error for each of the
+// messages. If the handler panics, all messages are acked with Retry.
+func (b *Batch) invoke(ctx context.Context, batch []Msg) (errs []error) {
+	log := LogFrom(ctx)
+	defer func() {
+		if v := recover(); v != nil {
+			pe := recovered(v)
+			log.With(map[string]interface{}{
+				"stack": string(pe.Stack),
+			}).Errorf("recovered from panic in batch func: %v", pe.Value)
+			errs = sameErr(len(batch), Retry)
+		}
+	}()
+
+	if b.ItemsFunc == nil {
+		return sameErr(len(batch), b.Func(ctx, batch))
+	}
+
+	errs = b.ItemsFunc(ctx, batch)
+	if errs == nil {
+		return sameErr(len(batch), nil)
+	} else if len(errs) != len(batch) {
+		log.Warnf("batch func returned %d result(s) for %d message(s), retrying all", len(errs), len(batch))
+		return sameErr(len(batch), Retry)
+	}
+	return errs
+}
+
+func (b *Batch) init() {
+	if b.Func == nil && b.ItemsFunc == nil {
+		b.Func = func(_ context.Context, _ []Msg) error {
+			return Skip
+		}
+	}
+	if b.Workers <= 0 {
+		b.Workers = 1
+	}
+	if b.Size <= 0 {
+		b.Size = 100
+	}
+	if b.Timeout <= 0 {
+		b.Timeout = 100 * time.Millisecond
+	}
+}
+
+func sameErr(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
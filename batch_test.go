@@ -0,0 +1,131 @@
+package fusion_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/fusion"
+)
+
+func TestBatch_Run(t *testing.T) {
+	t.Parallel()
+
+	msgs := func(ackAs func(string) func(error), vals ...string) []fusion.Msg {
+		var res []fusion.Msg
+		for _, val := range vals {
+			res = append(res, fusion.Msg{Val: []byte(val), Ack: ackAs(val)})
+		}
+		return res
+	}
+
+	t.Run("NoFunc", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		b := &fusion.Batch{}
+		assert.NoError(t, b.Run(context.Background(), msgStream(msgs(ackAs, "a")...)))
+		assert.Equal(t, map[string]error{"a": fusion.Skip}, acks())
+	})
+
+	t.Run("Func", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+
+		var sizes []int
+		b := &fusion.Batch{
+			Size:    2,
+			Timeout: 1 * time.Second,
+			Func: func(ctx context.Context, batch []fusion.Msg) error {
+				sizes = append(sizes, len(batch))
+				if string(batch[0].Val) == "c" {
+					return fusion.Fail
+				}
+				return nil
+			},
+		}
+		err := b.Run(context.Background(), msgStream(msgs(ackAs, "a", "b", "c", "d", "e")...))
+		assert.NoError(t, err)
+		assert.Equal(t, []int{2, 2, 1}, sizes)
+		assert.Equal(t, map[string]error{
+			"a": nil, "b": nil, "c": fusion.Fail, "d": fusion.Fail, "e": nil,
+		}, acks())
+	})
+
+	t.Run("ItemsFunc", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+
+		b := &fusion.Batch{
+			Size: 3,
+			ItemsFunc: func(ctx context.Context, batch []fusion.Msg) []error {
+				switch len(batch) {
+				case 3:
+					return []error{nil, fusion.Skip, fusion.Retry}
+				default:
+					return []error{nil} // mismatch.
+				}
+			},
+		}
+		err := b.Run(context.Background(), msgStream(msgs(ackAs, "a", "b", "c", "d", "e")...))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]error{
+			"a": nil, "b": fusion.Skip, "c": fusion.Retry, "d": fusion.Retry, "e": fusion.Retry,
+		}, acks())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		ackAs, _ := ackRecorder()
+
+		stream := make(chan fusion.Msg, 1)
+		stream <- msgs(ackAs, "a")[0]
+
+		handled := make(chan int, 1)
+		b := &fusion.Batch{
+			Timeout: 10 * time.Millisecond,
+			Func: func(ctx context.Context, batch []fusion.Msg) error {
+				handled <- len(batch)
+				return nil
+			},
+		}
+		done := make(chan error, 1)
+		go func() { done <- b.Run(context.Background(), stream) }()
+
+		// partial batch must be handed over while the stream is open.
+		assert.Equal(t, 1, <-handled)
+		close(stream)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stream := make(chan fusion.Msg)
+		b := &fusion.Batch{
+			Timeout: 1 * time.Hour,
+			Func: func(ctx context.Context, batch []fusion.Msg) error {
+				t.Errorf("Func must not be called, got %d message(s)", len(batch))
+				return nil
+			},
+		}
+		done := make(chan error, 1)
+		go func() { done <- b.Run(ctx, stream) }()
+
+		stream <- msgs(ackAs, "a")[0]
+		cancel()
+		assert.NoError(t, <-done)
+		assert.Equal(t, map[string]error{"a": fusion.Retry}, acks())
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+
+		b := &fusion.Batch{
+			Func: func(ctx context.Context, batch []fusion.Msg) error { panic("boom") },
+		}
+		err := b.Run(context.Background(), msgStream(msgs(ackAs, "a", "b")...))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]error{"a": fusion.Retry, "b": fusion.Retry}, acks())
+	})
+}
@@ -0,0 +1,268 @@
+package fusion
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var _ Proc = (*Breaker)(nil)
+
+// Circuit states of the Breaker.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// Breaker implements a circuit breaker Proc around another Proc. Breaker
+// tracks the outcome of acks and opens the circuit when the ratio of failures
+// crosses the threshold. While the circuit is open, no messages are pulled
+// from the stream. After OpenTimeout, the circuit half-opens and lets Probes
+// number of messages through. Circuit closes if all the probes succeed and
+// opens again otherwise, or if the probes are not acked within OpenTimeout.
+type Breaker struct {
+	// Proc to pass the messages on to.
+	Proc Proc
+
+	// FailureRatio is the ratio of failed acks within a Window that opens
+	// the circuit once at least MinRequests acks are seen. Defaults to 0.5
+	// within 10s with minimum of 10 acks.
+	FailureRatio float64
+	MinRequests  int
+	Window       time.Duration
+
+	// OpenTimeout is the duration for which the circuit stays open before
+	// half-opening. It is also the time within which the probes must be
+	// acked before the circuit opens again. Defaults to 30s.
+	OpenTimeout time.Duration
+
+	// Probes is the number of messages let through while half-open.
+	// Defaults to 1.
+	Probes int
+
+	// IsFailure decides if the ack error counts as a failure. Defaults to
+	// Retry and unknown errors since Skip and Fail are specific to the
+	// message rather than a sign of an unhealthy dependency.
+	IsFailure func(err error) bool
+
+	log     Log
+	metrics Metrics
+
+	mu        sync.Mutex
+	state     string
+	gen       int // incremented on every state change.
+	changed   chan struct{}
+	changedAt time.Time
+	probes    int // probes sent in the current half-open state.
+	passed    int // probes succeeded in the current half-open state.
+
+	windowStart time.Time
+	total       int
+	failures    int
+}
+
+// Run starts the wrapped Proc with the stream of messages allowed by the
+// circuit and blocks until it exits. Returns the error returned by the
+// wrapped Proc.
+func (br *Breaker) Run(ctx context.Context, stream <-chan Msg) error {
+	if err := br.init(ctx); err != nil {
+		return err
+	}
+
+	return Feed(ctx, br.Proc, func(ctx context.Context, out chan<- Msg) {
+		br.forward(ctx, stream, out)
+	})
+}
+
+func (br *Breaker) forward(ctx context.Context, stream <-chan Msg, out chan<- Msg) {
+	for {
+		gen, ok := br.acquire(ctx)
+		if !ok {
+			return
+		}
+
+		var msg Msg
+		select {
+		case <-ctx.Done():
+			return
+		case m, open := <-stream:
+			if !open {
+				return
+			}
+			msg = m
+		}
+
+		ack, once := msg.Ack, &sync.Once{}
+		msg.Ack = func(err error) {
+			once.Do(func() { br.record(gen, err) })
+			ack(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			msg.Ack(Retry)
+			return
+		case out <- msg:
+		}
+	}
+}
+
+// acquire blocks until the circuit allows pulling a message and returns the
+// generation of the state it was allowed in. Returns false if ctx is
+// cancelled while waiting.
+func (br *Breaker) acquire(ctx context.Context) (int, bool) {
+	for {
+		br.mu.Lock()
+		var wait time.Duration
+		switch br.state {
+		case circuitClosed:
+			gen := br.gen
+			br.mu.Unlock()
+			return gen, true
+
+		case circuitOpen:
+			remaining := br.OpenTimeout - time.Since(br.changedAt)
+			if remaining <= 0 {
+				br.transition(circuitHalfOpen)
+				br.mu.Unlock()
+				continue
+			}
+			wait = remaining
+
+		case circuitHalfOpen:
+			if br.probes < br.Probes {
+				br.probes++
+				gen := br.gen
+				br.mu.Unlock()
+				return gen, true
+			}
+
+			// probes that are never acked must not hold the circuit
+			// half-open forever.
+			remaining := br.OpenTimeout - time.Since(br.changedAt)
+			if remaining <= 0 {
+				br.log.Warnf("probe(s) not acked within %s, opening circuit", br.OpenTimeout)
+				br.transition(circuitOpen)
+				br.mu.Unlock()
+				continue
+			}
+			wait = remaining
+		}
+		changed := br.changed
+		br.mu.Unlock()
+
+		if !waitChange(ctx, changed, wait) {
+			return 0, false
+		}
+	}
+}
+
+// record updates the circuit with the outcome of a message that was let
+// through in the given generation.
+func (br *Breaker) record(gen int, err error) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if gen != br.gen {
+		// outcome of a message from an earlier state has no bearing on
+		// the current state.
+		return
+	}
+	failed := br.IsFailure(err)
+
+	switch br.state {
+	case circuitClosed:
+		if now := time.Now(); now.Sub(br.windowStart) > br.Window {
+			br.windowStart, br.total, br.failures = now, 0, 0
+		}
+		br.total++
+		if failed {
+			br.failures++
+		}
+		if br.total >= br.MinRequests && float64(br.failures)/float64(br.total) >= br.FailureRatio {
+			br.log.Warnf("%d of %d acks failed, opening circuit for %s", br.failures, br.total, br.OpenTimeout)
+			br.transition(circuitOpen)
+		}
+
+	case circuitHalfOpen:
+		if failed {
+			br.log.Warnf("probe failed, opening circuit for %s: %v", br.OpenTimeout, err)
+			br.transition(circuitOpen)
+			return
+		}
+		br.passed++
+		if br.passed >= br.Probes {
+			br.log.Infof("all %d probe(s) succeeded, closing circuit", br.Probes)
+			br.transition(circuitClosed)
+		}
+	}
+}
+
+// transition changes the state and wakes up the forwarder. Must be called
+// with mu held.
+func (br *Breaker) transition(state string) {
+	br.state = state
+	br.gen++
+	br.probes, br.passed = 0, 0
+	br.windowStart, br.total, br.failures = time.Now(), 0, 0
+	br.changedAt = time.Now()
+	if state == circuitHalfOpen {
+		br.log.Infof("circuit half-open, letting %d probe(s) through", br.Probes)
+	}
+
+	close(br.changed)
+	br.changed = make(chan struct{})
+	br.metrics.Count("fusion_breaker_transitions_total", 1, map[string]string{"state": state})
+}
+
+func (br *Breaker) init(ctx context.Context) error {
+	if br.Proc == nil {
+		return errors.New("proc must not be nil")
+	}
+	if br.FailureRatio <= 0 {
+		br.FailureRatio = 0.5
+	}
+	if br.MinRequests <= 0 {
+		br.MinRequests = 10
+	}
+	if br.Window <= 0 {
+		br.Window = 10 * time.Second
+	}
+	if br.OpenTimeout <= 0 {
+		br.OpenTimeout = 30 * time.Second
+	}
+	if br.Probes <= 0 {
+		br.Probes = 1
+	}
+	if br.IsFailure == nil {
+		br.IsFailure = isRetryable
+	}
+
+	br.log = LogFrom(ctx)
+	br.metrics = MetricsFrom(ctx)
+	br.state = circuitClosed
+	br.changed = make(chan struct{})
+	br.windowStart = time.Now()
+	return nil
+}
+
+// waitChange blocks until changed is closed or the timeout (if non-zero)
+// elapses. Returns false if ctx is cancelled while waiting.
+func waitChange(ctx context.Context, changed <-chan struct{}, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-changed:
+	case <-expired:
+	}
+	return true
+}
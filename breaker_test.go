@@ -0,0 +1,146 @@
+package fusion_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestBreaker_Run(t *testing.T) {
+	t.Parallel()
+
+	t.Run("NoProc", func(t *testing.T) {
+		br := &fusion.Breaker{}
+		assert.Error(t, br.Run(context.Background(), msgStream()))
+	})
+
+	t.Run("OpenAndRecover", func(t *testing.T) {
+		var healthy int32
+		var processed int64
+
+		mu := &sync.Mutex{}
+		var acks []error
+		ack := func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			acks = append(acks, err)
+		}
+
+		var messages []fusion.Msg
+		for i := 0; i < 20; i++ {
+			messages = append(messages, fusion.Msg{Ack: ack})
+		}
+
+		br := &fusion.Breaker{
+			MinRequests: 4,
+			OpenTimeout: 100 * time.Millisecond,
+			Proc: &fusion.Fn{
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					atomic.AddInt64(&processed, 1)
+					if atomic.LoadInt32(&healthy) == 0 {
+						return fusion.Retry
+					}
+					return nil
+				},
+			},
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- br.Run(context.Background(), msgStream(messages...)) }()
+
+		// circuit opens after 4 failures and no more messages are pulled.
+		time.Sleep(50 * time.Millisecond)
+		openCount := atomic.LoadInt64(&processed)
+		assert.True(t, openCount >= 4 && openCount <= 5, "processed %d", openCount)
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, openCount, atomic.LoadInt64(&processed))
+
+		// probe after the open timeout succeeds and closes the circuit.
+		atomic.StoreInt32(&healthy, 1)
+		require.NoError(t, <-done)
+		assert.Equal(t, int64(20), atomic.LoadInt64(&processed))
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Len(t, acks, 20)
+		assert.Equal(t, fusion.Retry, acks[0])
+		assert.NoError(t, acks[19])
+	})
+
+	t.Run("ProbeFails", func(t *testing.T) {
+		var processed int64
+		ctx, cancel := context.WithTimeout(context.Background(), 130*time.Millisecond)
+		defer cancel()
+
+		stream := make(chan fusion.Msg)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					close(stream)
+					return
+				case stream <- fusion.Msg{Ack: func(_ error) {}}:
+				}
+			}
+		}()
+
+		br := &fusion.Breaker{
+			MinRequests: 2,
+			OpenTimeout: 50 * time.Millisecond,
+			Proc: &fusion.Fn{
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					atomic.AddInt64(&processed, 1)
+					return fusion.Retry
+				},
+			},
+		}
+		require.NoError(t, br.Run(ctx, stream))
+
+		// 2 failures to open, a probe at 50ms and another one at 100ms.
+		count := atomic.LoadInt64(&processed)
+		assert.True(t, count >= 4 && count <= 5, "processed %d", count)
+	})
+	t.Run("ProbeNotAcked", func(t *testing.T) {
+		var received int64
+		ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+		defer cancel()
+
+		stream := make(chan fusion.Msg)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					close(stream)
+					return
+				case stream <- fusion.Msg{Ack: func(_ error) {}}:
+				}
+			}
+		}()
+
+		br := &fusion.Breaker{
+			MinRequests: 2,
+			OpenTimeout: 30 * time.Millisecond,
+			Proc: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+				for msg := range stream {
+					// the probes are never acked.
+					if atomic.AddInt64(&received, 1) <= 2 {
+						msg.Ack(fusion.Retry)
+					}
+				}
+				return nil
+			}),
+		}
+		require.NoError(t, br.Run(ctx, stream))
+
+		// circuit re-opens after the timeout and lets another probe through.
+		count := atomic.LoadInt64(&received)
+		assert.True(t, count >= 4, "received %d", count)
+	})
+}
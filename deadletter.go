@@ -0,0 +1,104 @@
+package fusion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	_ DeadLetter = (*JSONDeadLetter)(nil)
+	_ DeadLetter = (*MemDeadLetter)(nil)
+	_ DeadLetter = DeadLetterFn(nil)
+)
+
+// DeadLetter implementation is the sink for messages that could not be
+// processed (i.e., were acknowledged with Fail or exhausted all retries).
+// Messages written to a DeadLetter can be inspected and replayed later.
+type DeadLetter interface {
+	// Put should durably save the dead message. If Put returns error, the
+	// original message will be nAcked instead so that it is not lost.
+	Put(ctx context.Context, dm DeadMsg) error
+}
+
+// DeadMsg is a message that failed processing along with the details of
+// the failure.
+type DeadMsg struct {
+	Msg        Msg       `json:"msg"`
+	Error      string    `json:"error"`
+	Attempts   int       `json:"attempts"`
+	ReceivedAt time.Time `json:"received_at,omitempty"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// DeadLetterFn implements DeadLetter using a simple Go function.
+type DeadLetterFn func(ctx context.Context, dm DeadMsg) error
+
+// Put dispatches the dead message to the wrapped function.
+func (dlf DeadLetterFn) Put(ctx context.Context, dm DeadMsg) error { return dlf(ctx, dm) }
+
+// JSONDeadLetter implements a DeadLetter that writes dead messages as JSON
+// lines to an io.Writer (e.g., a file). The output can be read back using
+// LineStream and decoding each line into DeadMsg.
+type JSONDeadLetter struct {
+	To io.Writer // To is the writer to use.
+
+	mu sync.Mutex
+}
+
+// Put writes the dead message as a single JSON line.
+func (jdl *JSONDeadLetter) Put(_ context.Context, dm DeadMsg) error {
+	if jdl.To == nil {
+		return errors.New("field To must be set")
+	}
+
+	data, err := json.Marshal(dm)
+	if err != nil {
+		return err
+	}
+
+	jdl.mu.Lock()
+	defer jdl.mu.Unlock()
+	_, err = jdl.To.Write(append(data, '\n'))
+	return err
+}
+
+// MemDeadLetter implements an in-memory DeadLetter. Useful for tests.
+type MemDeadLetter struct {
+	mu   sync.Mutex
+	msgs []DeadMsg
+}
+
+// Put appends the dead message to the in-memory list.
+func (mdl *MemDeadLetter) Put(_ context.Context, dm DeadMsg) error {
+	mdl.mu.Lock()
+	defer mdl.mu.Unlock()
+	mdl.msgs = append(mdl.msgs, dm)
+	return nil
+}
+
+// Msgs returns all the dead messages collected so far.
+func (mdl *MemDeadLetter) Msgs() []DeadMsg {
+	mdl.mu.Lock()
+	defer mdl.mu.Unlock()
+	return append([]DeadMsg(nil), mdl.msgs...)
+}
+
+// putDead saves the message to the dead letter with the given cause and
+// attempts. The Ack function of the message is not invoked.
+func putDead(ctx context.Context, dl DeadLetter, msg Msg, cause error, attempts int, receivedAt time.Time) error {
+	dm := DeadMsg{
+		Msg:        msg,
+		Attempts:   attempts,
+		ReceivedAt: receivedAt,
+		FailedAt:   time.Now(),
+	}
+	dm.Msg.Ack = nil
+	if cause != nil {
+		dm.Error = cause.Error()
+	}
+	return dl.Put(ctx, dm)
+}
@@ -0,0 +1,116 @@
+package fusion_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestJSONDeadLetter_Put(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dl := &fusion.JSONDeadLetter{To: buf}
+
+	err := dl.Put(context.Background(), fusion.DeadMsg{
+		Msg:      fusion.Msg{Key: []byte("k"), Attribs: map[string]string{"topic": "foo"}},
+		Error:    "failed",
+		Attempts: 2,
+	})
+	require.NoError(t, err)
+
+	var got fusion.DeadMsg
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, []byte("k"), got.Msg.Key)
+	assert.Equal(t, "foo", got.Msg.Attribs["topic"])
+	assert.Equal(t, "failed", got.Error)
+	assert.Equal(t, 2, got.Attempts)
+}
+
+func TestFn_Run_DeadLetter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Routed", func(t *testing.T) {
+		dl := &fusion.MemDeadLetter{}
+		var acked error
+		fn := fusion.Fn{
+			DeadLetter: dl,
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				return fusion.Fail
+			},
+		}
+
+		err := fn.Run(context.Background(), msgStream(fusion.Msg{
+			Key: []byte("k"),
+			Ack: func(err error) { acked = err },
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, fusion.Fail, acked)
+		if msgs := dl.Msgs(); assert.Len(t, msgs, 1) {
+			assert.Equal(t, []byte("k"), msgs[0].Msg.Key)
+			assert.Equal(t, fusion.Fail.Error(), msgs[0].Error)
+			assert.Equal(t, 1, msgs[0].Attempts)
+		}
+	})
+
+	t.Run("PutFailed", func(t *testing.T) {
+		var acked error
+		fn := fusion.Fn{
+			DeadLetter: fusion.DeadLetterFn(func(ctx context.Context, dm fusion.DeadMsg) error {
+				return errors.New("failed")
+			}),
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				return fusion.Fail
+			},
+		}
+
+		err := fn.Run(context.Background(), msgStream(fusion.Msg{
+			Ack: func(err error) { acked = err },
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, fusion.Retry, acked)
+	})
+}
+
+func TestRunner_Run_DeadLetter(t *testing.T) {
+	dl := &fusion.MemDeadLetter{}
+	acks := map[string]error{}
+
+	fu := fusion.Runner{
+		DeadLetter: dl,
+		Stream: fusion.StreamFn(func() func(ctx context.Context) (*fusion.Msg, error) {
+			keys := []string{"ok", "fail"}
+			return func(ctx context.Context) (*fusion.Msg, error) {
+				if len(keys) == 0 {
+					return nil, errors.New("done")
+				}
+				key := keys[0]
+				keys = keys[1:]
+				return &fusion.Msg{
+					Key: []byte(key),
+					Ack: func(err error) { acks[key] = err },
+				}, nil
+			}
+		}()),
+		Proc: &fusion.Fn{
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				if string(msg.Key) == "fail" {
+					return fusion.Fail
+				}
+				return nil
+			},
+		},
+	}
+
+	require.NoError(t, fu.Run(context.Background()))
+	assert.Equal(t, map[string]error{"ok": nil, "fail": fusion.Fail}, acks)
+	if msgs := dl.Msgs(); assert.Len(t, msgs, 1) {
+		assert.Equal(t, []byte("fail"), msgs[0].Msg.Key)
+		assert.False(t, msgs[0].ReceivedAt.IsZero())
+	}
+}
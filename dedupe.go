@@ -0,0 +1,331 @@
+package fusion
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ Proc        = (*Dedupe)(nil)
+	_ DedupeStore = (*LRUDedupe)(nil)
+)
+
+// DedupeStore implementation records the ids of processed messages for
+// Dedupe. Implementations must be safe for concurrent use.
+type DedupeStore interface {
+	// Seen should return true if the id was marked and has not expired.
+	Seen(id string, now time.Time) (bool, error)
+
+	// Mark should record the id as processed until the expiry.
+	Mark(id string, expiry time.Time) error
+}
+
+// DedupeStats holds the number of duplicate (hit) and new (miss) messages
+// seen by Dedupe.
+type DedupeStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// Dedupe implements a Proc that drops the messages that were processed
+// already. Duplicates are acked with Skip without passing them on to the
+// wrapped Proc. A message is marked as processed when it is acked with nil
+// or Skip by the wrapped Proc. Messages with the same id as a message that
+// is still in-flight are nAcked with Retry, since it is not known yet if the
+// in-flight one will be processed. Messages with empty id are always passed
+// on.
+//
+// Dedupe turns at-least-once delivery into effectively-once processing as
+// long as the store outlives the redelivery window. If marking fails, the
+// message is acked anyway and a redelivery may be processed again.
+type Dedupe struct {
+	// Proc to pass the new messages on to.
+	Proc Proc
+
+	// IDFunc returns the id of the message. Defaults to Msg.Key. AttribKey
+	// can be used to dedupe by a message attribute.
+	IDFunc func(msg Msg) string
+
+	// Store records the processed ids. Use LRUDedupe for in-memory store
+	// or StateDedupe with a FileState for a store that survives restarts.
+	// Defaults to an LRUDedupe with default size.
+	Store DedupeStore
+
+	// TTL is the duration for which the ids of processed messages are
+	// remembered. Defaults to 24h.
+	TTL time.Duration
+
+	hits     int64
+	misses   int64
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+// Run starts the wrapped Proc with a stream of messages that were not seen
+// before and blocks until it exits. Returns the error returned by the wrapped
+// Proc.
+func (dd *Dedupe) Run(ctx context.Context, stream <-chan Msg) error {
+	if err := dd.init(); err != nil {
+		return err
+	}
+
+	return Feed(ctx, dd.Proc, func(ctx context.Context, out chan<- Msg) {
+		dd.forward(ctx, stream, out)
+	})
+}
+
+// Stats returns the number of hits and misses so far.
+func (dd *Dedupe) Stats() DedupeStats {
+	return DedupeStats{
+		Hits:   atomic.LoadInt64(&dd.hits),
+		Misses: atomic.LoadInt64(&dd.misses),
+	}
+}
+
+func (dd *Dedupe) forward(ctx context.Context, stream <-chan Msg, out chan<- Msg) {
+	log, metrics := LogFrom(ctx), MetricsFrom(ctx)
+
+	for {
+		var msg Msg
+		select {
+		case <-ctx.Done():
+			return
+		case m, open := <-stream:
+			if !open {
+				return
+			}
+			msg = m
+		}
+
+		id := dd.IDFunc(msg)
+		if id != "" {
+			dup, inFlight, err := dd.check(id)
+			if err != nil {
+				log.Warnf("failed to check for duplicate, will retry: %v", err)
+				msg.Ack(Retry)
+				continue
+			}
+
+			if inFlight {
+				metrics.Count("fusion_dedupe_total", 1, map[string]string{"result": "in_flight"})
+				msg.Ack(Retry)
+				continue
+			} else if dup {
+				atomic.AddInt64(&dd.hits, 1)
+				metrics.Count("fusion_dedupe_total", 1, map[string]string{"result": "hit"})
+				msg.Ack(Skip)
+				continue
+			}
+			atomic.AddInt64(&dd.misses, 1)
+			metrics.Count("fusion_dedupe_total", 1, map[string]string{"result": "miss"})
+			msg.Ack = dd.markOnAck(log, id, msg.Ack)
+		}
+
+		select {
+		case <-ctx.Done():
+			msg.Ack(Retry)
+			return
+		case out <- msg:
+		}
+	}
+}
+
+// check returns whether the id was processed already or is in-flight. If
+// neither, the id is added to the in-flight set.
+func (dd *Dedupe) check(id string) (dup, inFlight bool, err error) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	if _, found := dd.inFlight[id]; found {
+		return false, true, nil
+	}
+
+	seen, err := dd.Store.Seen(id, time.Now())
+	if err != nil || seen {
+		return seen, false, err
+	}
+	dd.inFlight[id] = struct{}{}
+	return false, false, nil
+}
+
+// markOnAck wraps the ack to mark the id as processed before acking the
+// message if it was processed.
+func (dd *Dedupe) markOnAck(log Log, id string, ack func(err error)) func(err error) {
+	once := &sync.Once{}
+	return func(err error) {
+		once.Do(func() {
+			dd.mu.Lock()
+			if err == nil || err == Skip {
+				if markErr := dd.Store.Mark(id, time.Now().Add(dd.TTL)); markErr != nil {
+					log.Warnf("failed to mark message '%s' as processed: %v", id, markErr)
+				}
+			}
+			delete(dd.inFlight, id)
+			dd.mu.Unlock()
+
+			ack(err)
+		})
+	}
+}
+
+func (dd *Dedupe) init() error {
+	if dd.Proc == nil {
+		return errors.New("proc must be set")
+	}
+	if dd.IDFunc == nil {
+		dd.IDFunc = func(msg Msg) string { return string(msg.Key) }
+	}
+	if dd.Store == nil {
+		dd.Store = &LRUDedupe{}
+	}
+	if dd.TTL <= 0 {
+		dd.TTL = 24 * time.Hour
+	}
+	dd.inFlight = map[string]struct{}{}
+	return nil
+}
+
+// LRUDedupe implements an in-memory DedupeStore that remembers up to Size ids.
+// When full, the least recently marked id is evicted even if it has not
+// expired yet.
+type LRUDedupe struct {
+	// Size is the maximum number of ids to remember. Defaults to 100000.
+	Size int
+
+	mu    sync.Mutex
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+type lruEntry struct {
+	id     string
+	expiry time.Time
+}
+
+// Seen returns true if the id was marked and has not expired.
+func (lru *LRUDedupe) Seen(id string, now time.Time) (bool, error) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.init()
+
+	el, found := lru.ids[id]
+	if !found {
+		return false, nil
+	} else if !el.Value.(*lruEntry).expiry.After(now) {
+		lru.order.Remove(el)
+		delete(lru.ids, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Mark records the id until the expiry evicting the oldest id if full.
+func (lru *LRUDedupe) Mark(id string, expiry time.Time) error {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.init()
+
+	if el, found := lru.ids[id]; found {
+		el.Value.(*lruEntry).expiry = expiry
+		lru.order.MoveToFront(el)
+		return nil
+	}
+
+	lru.ids[id] = lru.order.PushFront(&lruEntry{id: id, expiry: expiry})
+	for lru.order.Len() > lru.Size {
+		oldest := lru.order.Back()
+		lru.order.Remove(oldest)
+		delete(lru.ids, oldest.Value.(*lruEntry).id)
+	}
+	return nil
+}
+
+// Len returns the number of ids remembered including the expired ones that
+// were not evicted yet.
+func (lru *LRUDedupe) Len() int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.init()
+	return lru.order.Len()
+}
+
+func (lru *LRUDedupe) init() {
+	if lru.ids != nil {
+		return
+	}
+	if lru.Size <= 0 {
+		lru.Size = 100000
+	}
+	lru.order = list.New()
+	lru.ids = map[string]*list.Element{}
+}
+
+// StateDedupe returns a DedupeStore that records the ids in the StateStore
+// under the given prefix. With a FileState, processed ids survive restarts.
+// Expired ids are removed from the store periodically.
+func StateDedupe(store StateStore, prefix string) DedupeStore {
+	return &stateDedupe{store: store, prefix: prefix}
+}
+
+// stateDedupeSweep is the number of marks after which expired ids are swept.
+const stateDedupeSweep = 1024
+
+type stateDedupe struct {
+	store  StateStore
+	prefix string
+
+	mu    sync.Mutex
+	marks int
+}
+
+func (sd *stateDedupe) Seen(id string, now time.Time) (bool, error) {
+	val, err := sd.store.Get(sd.prefix + id)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return parseExpiry(val).After(now), nil
+}
+
+func (sd *stateDedupe) Mark(id string, expiry time.Time) error {
+	val := []byte(strconv.FormatInt(expiry.UnixNano(), 10))
+	if err := sd.store.Put(sd.prefix+id, val); err != nil {
+		return err
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.marks++
+	if sd.marks < stateDedupeSweep {
+		return nil
+	}
+	sd.marks = 0
+	return sd.sweep(time.Now())
+}
+
+// sweep deletes the expired ids from the store.
+func (sd *stateDedupe) sweep(now time.Time) error {
+	expired := map[string][]byte{}
+	err := sd.store.Range(sd.prefix, func(key string, val []byte) bool {
+		if !parseExpiry(val).After(now) {
+			expired[key] = nil
+		}
+		return true
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+	return sd.store.Commit(expired)
+}
+
+func parseExpiry(val []byte) time.Time {
+	nanos, _ := strconv.ParseInt(string(val), 10, 64)
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,152 @@
+package fusion_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestDedupe_Run(t *testing.T) {
+	t.Parallel()
+
+	// ackByVal acks each message with Retry if its value is "retry" and with
+	// nil otherwise and records the keys it received. A message is acked
+	// only after it is received, so a duplicate must be at least 2 messages
+	// apart to not be treated as in-flight.
+	ackByVal := func(received *[]string) fusion.Proc {
+		return fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+			for msg := range stream {
+				*received = append(*received, string(msg.Key))
+				if string(msg.Val) == "retry" {
+					msg.Ack(fusion.Retry)
+				} else {
+					msg.Ack(nil)
+				}
+			}
+			return nil
+		})
+	}
+
+	t.Run("NoProc", func(t *testing.T) {
+		dd := &fusion.Dedupe{}
+		assert.Error(t, dd.Run(context.Background(), msgStream()))
+	})
+
+	t.Run("Duplicates", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		var received []string
+		dd := &fusion.Dedupe{Proc: ackByVal(&received)}
+
+		err := dd.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("a"), Ack: ackAs("1")},
+			fusion.Msg{Key: []byte("b"), Ack: ackAs("2")},
+			fusion.Msg{Key: []byte("a"), Ack: ackAs("3")},
+			fusion.Msg{Ack: ackAs("4")},
+			fusion.Msg{Ack: ackAs("5")},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "", ""}, received)
+		assert.Equal(t, map[string]error{"1": nil, "2": nil, "3": fusion.Skip, "4": nil, "5": nil}, acks())
+		assert.Equal(t, fusion.DedupeStats{Hits: 1, Misses: 2}, dd.Stats())
+	})
+
+	t.Run("NotMarkedOnRetry", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		var received []string
+		dd := &fusion.Dedupe{
+			Proc:   ackByVal(&received),
+			IDFunc: fusion.AttribKey("id"),
+		}
+
+		id := func(v string) map[string]string { return map[string]string{"id": v} }
+		err := dd.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("1"), Val: []byte("retry"), Attribs: id("x"), Ack: ackAs("1")},
+			fusion.Msg{Key: []byte("2"), Attribs: id("y"), Ack: ackAs("2")},
+			fusion.Msg{Key: []byte("3"), Attribs: id("x"), Ack: ackAs("3")},
+			fusion.Msg{Key: []byte("4"), Attribs: id("z"), Ack: ackAs("4")},
+			fusion.Msg{Key: []byte("5"), Attribs: id("x"), Ack: ackAs("5")},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1", "2", "3", "4"}, received)
+		assert.Equal(t, map[string]error{
+			"1": fusion.Retry, "2": nil, "3": nil, "4": nil, "5": fusion.Skip,
+		}, acks())
+	})
+
+	t.Run("InFlight", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		dd := &fusion.Dedupe{
+			Proc: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+				var held []fusion.Msg
+				for msg := range stream {
+					held = append(held, msg)
+				}
+				for _, msg := range held {
+					msg.Ack(nil)
+				}
+				return nil
+			}),
+		}
+
+		err := dd.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("a"), Ack: ackAs("1")},
+			fusion.Msg{Key: []byte("a"), Ack: ackAs("2")},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]error{"1": nil, "2": fusion.Retry}, acks())
+		assert.Equal(t, fusion.DedupeStats{Misses: 1}, dd.Stats())
+	})
+
+	t.Run("PersistentStore", func(t *testing.T) {
+		state := &fusion.MemState{}
+		var received []string
+
+		for i := 0; i < 2; i++ {
+			dd := &fusion.Dedupe{
+				Proc:  ackByVal(&received),
+				Store: fusion.StateDedupe(state, "dedupe/"),
+			}
+			require.NoError(t, dd.Run(context.Background(), msgStream(
+				fusion.Msg{Key: []byte("a"), Ack: func(_ error) {}},
+			)))
+		}
+		assert.Equal(t, []string{"a"}, received)
+		assert.Equal(t, map[string]string{"dedupe/a": ""}, keysOf(rangeAll(t, state, "")))
+	})
+}
+
+func TestLRUDedupe(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	lru := &fusion.LRUDedupe{Size: 2}
+
+	require.NoError(t, lru.Mark("a", now.Add(time.Minute)))
+	require.NoError(t, lru.Mark("b", now.Add(time.Second)))
+	require.NoError(t, lru.Mark("c", now.Add(time.Minute)))
+	assert.Equal(t, 2, lru.Len())
+
+	seen := func(id string, at time.Time) bool {
+		ok, err := lru.Seen(id, at)
+		require.NoError(t, err)
+		return ok
+	}
+	assert.False(t, seen("a", now), "a must be evicted")
+	assert.True(t, seen("b", now))
+	assert.False(t, seen("b", now.Add(time.Second)), "b must be expired")
+	assert.True(t, seen("c", now))
+	assert.Equal(t, 1, lru.Len())
+}
+
+func keysOf(m map[string]string) map[string]string {
+	keys := map[string]string{}
+	for k := range m {
+		keys[k] = ""
+	}
+	return keys
+}
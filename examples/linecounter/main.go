@@ -38,7 +38,7 @@ func main() {
 }
 
 func callOnInterrupt(cancel context.CancelFunc) {
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	<-sigCh
 	cancel()
@@ -0,0 +1,28 @@
+package fusion
+
+import "context"
+
+// Feed runs the proc with the stream of messages sent by feed and blocks
+// until both return. It is meant for Procs that wrap another Proc and
+// transform or filter its stream. feed runs in its own goroutine and the
+// stream is closed once it returns. The ctx passed to feed is cancelled when
+// the proc exits so that feed stops even if the proc exited early; messages
+// feed can no longer send must be nAcked with Retry. Returns the error
+// returned by the proc.
+func Feed(ctx context.Context, proc Proc, feed func(ctx context.Context, out chan<- Msg)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := make(chan Msg)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(out)
+		feed(ctx, out)
+	}()
+
+	err := proc.Run(ctx, out)
+	cancel() // unblock the feed if the proc exited early.
+	<-done
+	return err
+}
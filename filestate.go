@@ -0,0 +1,163 @@
+package fusion
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spy16/fusion/internal/applog"
+)
+
+var _ StateStore = (*FileState)(nil)
+
+// stateCompactMin is the minimum number of writes in the log before it is
+// considered for compaction.
+const stateCompactMin = 1024
+
+// FileState implements a persistent StateStore using an append-only log file
+// and an in-memory copy of the state. Every commit is appended to the log as
+// a single record and hence is applied entirely or not at all after a crash.
+// When overwritten and deleted keys make up more than half of the log, the
+// log is compacted into a snapshot of the current state. Commits are fsync'd
+// before returning, so they also survive a crash of the host.
+type FileState struct {
+	mu     sync.Mutex
+	log    *applog.File
+	writes int
+	mem    MemState
+}
+
+// OpenFileState opens the state log at path (creating it if required) and
+// restores the state from it.
+func OpenFileState(path string) (*FileState, error) {
+	fs := &FileState{}
+
+	log, err := applog.Open(path, fs.restoreLog)
+	if err != nil {
+		return nil, err
+	}
+	fs.log = log
+	return fs, nil
+}
+
+// Get returns the value of the key or ErrNotFound.
+func (fs *FileState) Get(key string) ([]byte, error) { return fs.mem.Get(key) }
+
+// Put sets the value of the key.
+func (fs *FileState) Put(key string, val []byte) error {
+	return fs.Commit(map[string][]byte{key: nonNil(val)})
+}
+
+// Delete removes the key.
+func (fs *FileState) Delete(key string) error {
+	return fs.Commit(map[string][]byte{key: nil})
+}
+
+// Range calls fn for every key with the prefix in the order of keys.
+func (fs *FileState) Range(prefix string, fn func(key string, val []byte) bool) error {
+	return fs.mem.Range(prefix, fn)
+}
+
+// Commit appends the batch to the log as a single record, fsyncs it and
+// applies it.
+func (fs *FileState) Commit(batch map[string][]byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.log == nil {
+		return os.ErrClosed
+	}
+
+	if err := fs.log.Append(stateRecord{Writes: batch}, true); err != nil {
+		return err
+	}
+	fs.writes += len(batch)
+	_ = fs.mem.Commit(batch)
+	return fs.maybeCompact()
+}
+
+// Snapshot writes the current state as JSON to w.
+func (fs *FileState) Snapshot(w io.Writer) error { return fs.mem.Snapshot(w) }
+
+// Restore replaces the state with the snapshot read from r and rewrites the
+// log with it.
+func (fs *FileState) Restore(r io.Reader) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.log == nil {
+		return os.ErrClosed
+	}
+
+	if err := fs.mem.Restore(r); err != nil {
+		return err
+	}
+	return fs.compact()
+}
+
+// Len returns the number of keys in the state.
+func (fs *FileState) Len() int {
+	fs.mem.mu.RLock()
+	defer fs.mem.mu.RUnlock()
+	return len(fs.mem.data)
+}
+
+// Close flushes the log to disk and closes it. State must not be used after
+// Close.
+func (fs *FileState) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.log == nil {
+		return nil
+	}
+
+	err := fs.log.Close()
+	fs.log = nil
+	return err
+}
+
+func (fs *FileState) maybeCompact() error {
+	if fs.writes < stateCompactMin || fs.Len()*2 > fs.writes {
+		return nil
+	}
+	return fs.compact()
+}
+
+// compact replaces the log with a single record containing the snapshot of
+// the current state.
+func (fs *FileState) compact() error {
+	fs.mem.mu.RLock()
+	defer fs.mem.mu.RUnlock()
+
+	rec := stateRecord{Reset: true, Writes: fs.mem.data}
+	err := fs.log.Rewrite(func(enc *json.Encoder) error { return enc.Encode(rec) })
+	if err != nil {
+		return err
+	}
+	fs.writes = len(rec.Writes)
+	return nil
+}
+
+// restoreLog applies a commit read from the log while opening the state.
+func (fs *FileState) restoreLog(line []byte) error {
+	var rec stateRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+
+	if rec.Reset {
+		fs.mem.data, fs.writes = nil, 0
+	}
+	fs.mem.data = applyBatch(fs.mem.data, rec.Writes)
+	fs.writes += len(rec.Writes)
+	return nil
+}
+
+// stateRecord is a commit in the state log. Reset is set on the snapshot
+// record written by compaction.
+type stateRecord struct {
+	Reset  bool              `json:"reset,omitempty"`
+	Writes map[string][]byte `json:"writes"`
+}
@@ -3,8 +3,8 @@ package fusion
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -23,54 +23,214 @@ type Runner struct {
 	// not be drained.
 	DrainTime time.Duration
 
+	// ShutdownTimeout is the maximum time to wait for the in-flight messages
+	// to be acknowledged when ctx is cancelled. Stream is stopped as soon as
+	// ctx is cancelled, but the Proc keeps running until all the messages it
+	// received are acknowledged or the timeout elapses. If not set, Proc is
+	// cancelled along with the Stream.
+	ShutdownTimeout time.Duration
+
+	// FlushTimeout is the maximum time given to the Stream to flush (e.g.,
+	// commit offsets) after the Proc exits, if the Stream implements the
+	// Flusher interface. Defaults to 5s.
+	FlushTimeout time.Duration
+
+	// DeadLetter can be set to route messages that are acknowledged with
+	// Fail to a dead letter sink. If saving to the dead letter fails, the
+	// message is nAcked with Retry instead. Do not set DeadLetter on both
+	// Runner and the Proc to avoid duplicates.
+	DeadLetter DeadLetter
+
 	// Log to be used by the Runner. If not set, a no-op value will be
 	// used.
 	Log Log
+
+	// Metrics to be used by the Runner and made available to the Stream
+	// and Proc through MetricsFrom. If not set, a no-op value will be used.
+	Metrics Metrics
+
+	// Tracer can be set to trace messages through the pipeline. Runner
+	// starts a span for each message as a child of the trace context in
+	// the message attributes (if any) and makes the tracer available to
+	// the Proc through TracerFrom. If not set, tracing is disabled.
+	Tracer Tracer
+
+	// State can be set to provide key-value state to the Proc through
+	// StateFrom. Writes made while processing a message are committed only
+	// when the message is acknowledged successfully. Use FileState for state
+	// that must survive restarts. Runner does not close the store.
+	State StateStore
+
+	// Supervise can be set to restart the Stream and Proc on failures
+	// instead of ending the run. See Supervisor for details.
+	Supervise *Supervisor
+
+	inFlight *inFlight
 }
 
 // Run spawns all the worker goroutines and blocks until all of them exit.
 // Worker threads exit when context is cancelled or when source closes. It
 // returns any error that was returned from the source.
+//
+// When ctx is cancelled, Run shuts down gracefully: the Stream is stopped,
+// in-flight messages are given ShutdownTimeout to be acknowledged, then the
+// Proc is cancelled and finally the Stream is flushed if it implements the
+// Flusher interface.
 func (fu Runner) Run(ctx context.Context) error {
 	if err := fu.init(); err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(withLog(ctx, fu.Log))
-	defer cancel()
+	ctx = withMetrics(withLog(ctx, fu.Log), fu.Metrics)
+	if fu.Tracer != nil {
+		ctx = withTracer(ctx, fu.Tracer)
+	}
+	if fu.State != nil {
+		ctx = withStateStore(ctx, fu.State)
+	}
 
-	streamCh, err := fu.Stream.Out(ctx)
+	streamCtx, stopStream := context.WithCancel(ctx)
+	defer stopStream()
+
+	// proc must outlive the stream during shutdown to finish the messages
+	// it has already received.
+	procCtx, cancelProc := context.WithCancel(detach(ctx))
+	defer cancelProc()
+
+	streamCh, err := fu.openStream(streamCtx)
 	if err != nil {
 		return err
 	} else if streamCh == nil {
 		return io.EOF
 	}
 
-	if err := fu.Proc.Run(ctx, streamCh); err != nil {
-		fu.Log(map[string]interface{}{
-			"level":   "warn",
-			"message": fmt.Sprintf("proc exited with error: %v", err),
-		})
+	streamCh = fu.track(procCtx, streamCtx.Done(), streamCh)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		select {
+		case <-procCtx.Done():
+		case <-ctx.Done():
+			fu.shutdown()
+			cancelProc()
+		}
+	}()
+
+	err = fu.runProc(procCtx, streamCh)
+	if err != nil {
+		fu.Log.Warnf("proc exited with error: %v", err)
 		fu.drainAll(streamCh)
-		return err
 	}
+	cancelProc()
+	<-shutdownDone
 
-	return nil
+	stopStream()
+	fu.flush(ctx)
+	if err == nil && fu.Supervise != nil {
+		err = fu.Supervise.err()
+	}
+	return err
+}
+
+// track forwards all messages from the stream to the returned channel after
+// wrapping the Ack so that ack outcomes are recorded, in-flight messages are
+// tracked and failed messages go to the dead letter. Once stop is closed,
+// messages that are still coming from the stream are nAcked with Retry.
+func (fu *Runner) track(ctx context.Context, stop <-chan struct{}, in <-chan Msg) <-chan Msg {
+	out := make(chan Msg)
+	go func() {
+		defer close(out)
+
+		for msg := range in {
+			fu.Metrics.Count("fusion_runner_messages_total", 1, nil)
+
+			var span Span
+			if fu.Tracer != nil {
+				span = fu.Tracer.Start("fusion.runner", ExtractTrace(msg))
+				msg.Attribs = withAttrib(msg.Attribs, TraceParentAttrib, span.Context().String())
+			}
+			fu.inFlight.add()
+			msg.Ack = fu.wrapAck(ctx, msg, span, time.Now())
+
+			select {
+			case <-stop:
+				msg.Ack(Retry)
+				for msg := range in {
+					msg.Ack(Retry)
+				}
+				return
+			case out <- msg:
+			}
+		}
+	}()
+	return out
+}
+
+// shutdown waits for the in-flight messages to be acknowledged for up to
+// ShutdownTimeout and reports the outcome.
+func (fu *Runner) shutdown() {
+	pending := fu.inFlight.len()
+	fu.Log.Infof("shutting down, waiting for %d in-flight message(s)", pending)
+
+	abandoned := fu.inFlight.wait(fu.ShutdownTimeout)
+	completed := pending - abandoned
+	if completed < 0 {
+		completed = 0
+	}
+
+	fu.Metrics.Count("fusion_runner_shutdown_messages_total", float64(completed), map[string]string{"result": "completed"})
+	fu.Metrics.Count("fusion_runner_shutdown_messages_total", float64(abandoned), map[string]string{"result": "abandoned"})
+	fu.Log.With(map[string]interface{}{
+		"completed": completed,
+		"abandoned": abandoned,
+	}).Infof("shutdown complete, %d message(s) completed, %d abandoned", completed, abandoned)
+}
+
+// flush lets the Stream finalise after the Proc has exited.
+func (fu *Runner) flush(ctx context.Context) {
+	flusher, ok := fu.Stream.(Flusher)
+	if !ok {
+		return
+	}
+
+	flushCtx, cancel := context.WithTimeout(detach(ctx), fu.FlushTimeout)
+	defer cancel()
+	if err := flusher.Flush(flushCtx); err != nil {
+		fu.Log.Warnf("failed to flush stream: %v", err)
+	}
+}
+
+func (fu *Runner) wrapAck(ctx context.Context, msg Msg, span Span, receivedAt time.Time) func(err error) {
+	once := &sync.Once{}
+	return func(err error) {
+		once.Do(func() {
+			if err == Fail && fu.DeadLetter != nil {
+				if dlErr := putDead(ctx, fu.DeadLetter, msg, err, 1, receivedAt); dlErr != nil {
+					fu.Log.Warnf("failed to write to dead letter, will retry: %v", dlErr)
+					err = Retry
+				}
+			}
+
+			tags := map[string]string{"result": ResultLabel(err)}
+			fu.Metrics.Count("fusion_runner_acks_total", 1, tags)
+			fu.Metrics.Observe("fusion_runner_ack_latency_seconds", time.Since(receivedAt).Seconds(), tags)
+			if span != nil {
+				span.End(err)
+			}
+			msg.Ack(err)
+			fu.inFlight.done()
+		})
+	}
 }
 
 func (fu *Runner) drainAll(ch <-chan Msg) {
 	if fu.DrainTime == 0 {
-		fu.Log(map[string]interface{}{
-			"level":   "warn",
-			"message": "drain time is not set, not draining stream",
-		})
+		fu.Log.Warnf("drain time is not set, not draining stream")
 		return
 	}
 
-	fu.Log(map[string]interface{}{
-		"level":   "info",
-		"message": fmt.Sprintf("drain time is set, waiting for %s", fu.DrainTime),
-	})
+	fu.Log.Infof("drain time is set, waiting for %s", fu.DrainTime)
 	for {
 		select {
 		case <-time.After(fu.DrainTime):
@@ -90,20 +250,96 @@ func (fu *Runner) init() error {
 		fu.Log = func(_ map[string]interface{}) {}
 	}
 
+	if fu.Metrics == nil {
+		fu.Metrics = noOpMetrics{}
+	}
+
+	if fu.FlushTimeout <= 0 {
+		fu.FlushTimeout = 5 * time.Second
+	}
+	fu.inFlight = newInFlight()
+
+	if fu.Supervise != nil {
+		fu.Supervise.init()
+	}
+
 	if fu.Stream == nil {
 		return errors.New("stream must not be nil")
 	}
 
 	if fu.Proc == nil {
-		fu.Log(map[string]interface{}{
-			"level":   "warn",
-			"message": "proc is not set, using no-op",
-		})
+		fu.Log.Warnf("proc is not set, using no-op")
 		fu.Proc = &Fn{}
 	}
 	return nil
 }
 
-// Log implementation provides structured logging facilities for fusion
-// components.
-type Log func(_ map[string]interface{})
+// inFlight tracks the number of messages that are delivered to the Proc but
+// not acknowledged yet.
+type inFlight struct {
+	mu    sync.Mutex
+	count int
+	idle  chan struct{} // closed when count drops to zero.
+}
+
+func newInFlight() *inFlight {
+	idle := make(chan struct{})
+	close(idle)
+	return &inFlight{idle: idle}
+}
+
+func (f *inFlight) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.count == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.count++
+}
+
+func (f *inFlight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.count--
+	if f.count == 0 {
+		close(f.idle)
+	}
+}
+
+func (f *inFlight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.count
+}
+
+// wait blocks until there are no messages in flight or the timeout elapses
+// and returns the number of messages still in flight.
+func (f *inFlight) wait(timeout time.Duration) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		f.mu.Lock()
+		count, idle := f.count, f.idle
+		f.mu.Unlock()
+		if count == 0 {
+			return 0
+		}
+
+		select {
+		case <-idle:
+		case <-timer.C:
+			return f.len()
+		}
+	}
+}
+
+// detach returns a context that carries the values of ctx but is never
+// cancelled.
+func detach(ctx context.Context) context.Context { return detachedCtx{ctx} }
+
+type detachedCtx struct{ context.Context }
+
+func (detachedCtx) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedCtx) Done() <-chan struct{}       { return nil }
+func (detachedCtx) Err() error                  { return nil }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
@@ -73,8 +74,98 @@ func TestRunner_Run(t *testing.T) {
 	})
 }
 
+func TestRunner_Run_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	run := func(timeout time.Duration, fn func(ctx context.Context, msg Msg) error) (acks []error, report map[string]interface{}, flushed bool) {
+		mu := &sync.Mutex{}
+		ctx, cancel := context.WithCancel(context.Background())
+		received := make(chan struct{})
+
+		fu := Runner{
+			ShutdownTimeout: timeout,
+			Log: func(entry map[string]interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				if _, found := entry["abandoned"]; found {
+					report = entry
+				}
+			},
+			Stream: &fakeStream{
+				OutFunc: func(ctx context.Context) (<-chan Msg, error) {
+					ch := make(chan Msg)
+					go func() {
+						defer close(ch)
+						select {
+						case <-ctx.Done():
+						case ch <- Msg{Ack: func(err error) {
+							mu.Lock()
+							defer mu.Unlock()
+							acks = append(acks, err)
+						}}:
+						}
+					}()
+					return ch, nil
+				},
+				FlushFunc: func(ctx context.Context) error {
+					mu.Lock()
+					defer mu.Unlock()
+					flushed = len(acks) > 0
+					return nil
+				},
+			},
+			Proc: &Fn{
+				Func: func(ctx context.Context, msg Msg) error {
+					close(received)
+					return fn(ctx, msg)
+				},
+			},
+		}
+
+		go func() {
+			<-received
+			cancel()
+		}()
+		assert.NoError(t, fu.Run(ctx))
+
+		mu.Lock()
+		defer mu.Unlock()
+		return acks, report, flushed
+	}
+
+	t.Run("Completed", func(t *testing.T) {
+		acks, report, flushed := run(1*time.Second, func(ctx context.Context, msg Msg) error {
+			time.Sleep(100 * time.Millisecond)
+			return ctx.Err()
+		})
+		assert.Equal(t, []error{nil}, acks)
+		assert.True(t, flushed)
+		assert.Equal(t, 1, report["completed"])
+		assert.Equal(t, 0, report["abandoned"])
+	})
+
+	t.Run("Abandoned", func(t *testing.T) {
+		acks, report, flushed := run(100*time.Millisecond, func(ctx context.Context, msg Msg) error {
+			<-ctx.Done()
+			return Retry
+		})
+		assert.Equal(t, []error{Retry}, acks)
+		assert.True(t, flushed)
+		assert.Equal(t, 0, report["completed"])
+		assert.Equal(t, 1, report["abandoned"])
+	})
+}
+
 type fakeStream struct {
-	OutFunc func(ctx context.Context) (<-chan Msg, error)
+	OutFunc   func(ctx context.Context) (<-chan Msg, error)
+	FlushFunc func(ctx context.Context) error
 }
 
 func (f fakeStream) Out(ctx context.Context) (<-chan Msg, error) { return f.OutFunc(ctx) }
+
+func (f fakeStream) Flush(ctx context.Context) error {
+	if f.FlushFunc == nil {
+		return nil
+	}
+	return f.FlushFunc(ctx)
+}
@@ -0,0 +1,35 @@
+package fusion_test
+
+import (
+	"sync"
+
+	"github.com/spy16/fusion"
+)
+
+func msgStream(messages ...fusion.Msg) <-chan fusion.Msg {
+	ch := make(chan fusion.Msg, len(messages))
+	for _, msg := range messages {
+		ch <- msg
+	}
+	close(ch)
+	return ch
+}
+
+// ackRecorder returns a function for creating Ack functions that record the
+// ack error against the given value and a function to read the records.
+func ackRecorder() (func(val string) func(err error), func() map[string]error) {
+	mu := &sync.Mutex{}
+	acks := map[string]error{}
+	ackAs := func(val string) func(err error) {
+		return func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			acks[val] = err
+		}
+	}
+	return ackAs, func() map[string]error {
+		mu.Lock()
+		defer mu.Unlock()
+		return acks
+	}
+}
@@ -0,0 +1,125 @@
+// Package applog implements the append-only log of JSON records used by the
+// file-backed stores (i.e., fusion.FileState and retry.FileQ).
+package applog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// File is an append-only log file with one JSON record per line. File is not
+// safe for concurrent use.
+type File struct {
+	path string
+	file *os.File
+}
+
+// Open opens the log at path (creating it if required) and calls read with
+// each record in it, in order. A partially written record at the end of the
+// log (i.e., from a crash) is discarded. If read returns error, the log is
+// considered corrupt.
+func Open(path string, read func(rec []byte) error) (*File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := replay(f, read); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &File{path: path, file: f}, nil
+}
+
+// Append writes the record to the end of the log. If sync is set, the log is
+// fsync'd before returning so that the record survives a crash of the host.
+func (lf *File) Append(rec interface{}, sync bool) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := lf.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		return lf.file.Sync()
+	}
+	return nil
+}
+
+// Rewrite atomically replaces the log with the records written by write to
+// the encoder (e.g., to compact it). The new log is fsync'd before it
+// replaces the old one.
+func (lf *File) Rewrite(write func(enc *json.Encoder) error) error {
+	tmpPath := lf.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	if err := write(json.NewEncoder(w)); err != nil {
+		_ = tmp.Close()
+		return err
+	} else if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	} else if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	} else if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, lf.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_ = lf.file.Close()
+	lf.file = f
+	return nil
+}
+
+// Close flushes the log to disk and closes it.
+func (lf *File) Close() error {
+	err := lf.file.Sync()
+	if closeErr := lf.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func replay(f *os.File, read func(rec []byte) error) error {
+	rd := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// partially written record from a crash. discard it.
+				if err := f.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if err := read(line); err != nil {
+			return fmt.Errorf("corrupt record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+	}
+
+	_, err := f.Seek(offset, io.SeekStart)
+	return err
+}
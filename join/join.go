@@ -0,0 +1,118 @@
+// Package join provides fusion Streams that join the messages of two streams
+// by key. StreamTable enriches a stream with the latest value per key of a
+// table stream and StreamStream joins messages of two streams that arrive
+// within a time window of each other.
+package join
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/spy16/fusion"
+)
+
+// Type of the join.
+type Type int
+
+const (
+	// Inner join emits only the messages that have a match. Unmatched
+	// messages are acked with Skip.
+	Inner Type = iota
+
+	// Left join emits the messages of the left stream even if they have no
+	// match, with nil right message.
+	Left
+)
+
+// Attributes of the joined messages in addition to the attributes of the left
+// message. Attributes of the right message are included with RightPrefix.
+const (
+	MatchedAttrib = "join_matched"
+	RightPrefix   = "right."
+)
+
+// CombineFunc returns the value of the joined message. right is nil for the
+// unmatched messages in a Left join.
+type CombineFunc func(left fusion.Msg, right *fusion.Msg) ([]byte, error)
+
+// JSONCombine is the default CombineFunc. It returns a JSON object with the
+// values of the messages as "left" and "right". Values that are valid JSON
+// are embedded as is and others as strings.
+func JSONCombine(left fusion.Msg, right *fusion.Msg) ([]byte, error) {
+	pair := map[string]interface{}{
+		"left":  jsonVal(left.Val),
+		"right": nil,
+	}
+	if right != nil {
+		pair["right"] = jsonVal(right.Val)
+	}
+	return json.Marshal(pair)
+}
+
+// joined returns the joined message for left and right with ack set to ack.
+// Joined message retains the key of the left message. If combine fails, the
+// message is acked with Fail and false is returned.
+func joined(ctx context.Context, combine CombineFunc, key string, left fusion.Msg, right *fusion.Msg, ack func(err error)) (fusion.Msg, bool) {
+	attribs := map[string]string{}
+	for k, v := range left.Attribs {
+		attribs[k] = v
+	}
+	attribs[MatchedAttrib] = "false"
+	if right != nil {
+		for k, v := range right.Attribs {
+			attribs[RightPrefix+k] = v
+		}
+		attribs[MatchedAttrib] = "true"
+	}
+
+	val, err := combine(left, right)
+	if err != nil {
+		fusion.LogFrom(ctx).Warnf("failed to combine messages for key '%s': %v", key, err)
+		ack(fusion.Fail)
+		return fusion.Msg{}, false
+	}
+
+	fusion.MetricsFrom(ctx).Count("fusion_join_emitted_total", 1, map[string]string{
+		"matched": attribs[MatchedAttrib],
+	})
+	return fusion.Msg{
+		Key:     left.Key,
+		Val:     val,
+		Attribs: attribs,
+		Ack:     ack,
+	}, true
+}
+
+// send writes the message to out or nAcks it with Retry if ctx is cancelled.
+func send(ctx context.Context, out chan<- fusion.Msg, msg fusion.Msg) bool {
+	select {
+	case <-ctx.Done():
+		msg.Ack(fusion.Retry)
+		return false
+	case out <- msg:
+		return true
+	}
+}
+
+// flush invokes Flush on the streams that implement fusion.Flusher and
+// returns the first error.
+func flush(ctx context.Context, streams ...fusion.Stream) error {
+	var firstErr error
+	for _, stream := range streams {
+		if f, ok := stream.(fusion.Flusher); ok {
+			if err := f.Flush(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func msgKey(msg fusion.Msg) string { return string(msg.Key) }
+
+func jsonVal(val []byte) interface{} {
+	if len(val) > 0 && json.Valid(val) {
+		return json.RawMessage(val)
+	}
+	return string(val)
+}
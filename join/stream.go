@@ -0,0 +1,255 @@
+package join
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/spy16/fusion"
+)
+
+var (
+	_ fusion.Stream  = (*StreamStream)(nil)
+	_ fusion.Flusher = (*StreamStream)(nil)
+)
+
+// StreamStream implements a fusion Stream that joins the messages of Left and
+// Right streams with the same key that arrive within Window of each other. A
+// message may match multiple messages of the other side, in which case a
+// joined message is emitted for each pair. Messages are buffered for Window
+// after they arrive. In a Left join, Left messages that did not match any
+// Right message are emitted when they leave the buffer.
+//
+// Joined messages are acked to both the parents. Parents are acked once they
+// leave the buffer and all the joined messages of theirs are acked. Parents
+// without any joined message are acked with Skip. Buffered messages are
+// nAcked with Retry when ctx is cancelled.
+type StreamStream struct {
+	// Left and Right are the streams to be joined.
+	Left  fusion.Stream
+	Right fusion.Stream
+
+	// LeftKey and RightKey return the keys to join the messages on. Both
+	// default to Msg.Key.
+	LeftKey  func(msg fusion.Msg) string
+	RightKey func(msg fusion.Msg) string
+
+	// Window is the maximum difference between the arrival times of the
+	// messages to be joined.
+	Window time.Duration
+
+	// Type of the join. Defaults to Inner.
+	Type Type
+
+	// Combine returns the value of the joined message. Defaults to
+	// JSONCombine.
+	Combine CombineFunc
+
+	// TickInterval is the interval at which expired messages are removed
+	// from the buffer when no messages arrive. Defaults to 1s.
+	TickInterval time.Duration
+}
+
+type entry struct {
+	msg     fusion.Msg
+	at      time.Time
+	group   *fusion.AckGroup
+	matched bool
+}
+
+// buffer holds the messages of one side by key in the order of arrival.
+type buffer map[string][]*entry
+
+// Out starts both the streams and returns the stream of joined messages. The
+// returned channel is closed when both the streams end or ctx is cancelled.
+func (ss *StreamStream) Out(ctx context.Context) (<-chan fusion.Msg, error) {
+	if err := ss.init(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	leftCh, err := ss.Left.Out(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	rightCh, err := ss.Right.Out(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan fusion.Msg)
+	go func() {
+		defer cancel()
+		defer close(out)
+		ss.join(ctx, leftCh, rightCh, out)
+	}()
+	return out, nil
+}
+
+// Flush flushes both the streams if they implement fusion.Flusher.
+func (ss *StreamStream) Flush(ctx context.Context) error {
+	return flush(ctx, ss.Left, ss.Right)
+}
+
+func (ss *StreamStream) join(ctx context.Context, leftCh, rightCh <-chan fusion.Msg, out chan<- fusion.Msg) {
+	metrics := fusion.MetricsFrom(ctx)
+	lefts, rights := buffer{}, buffer{}
+
+	ticker := time.NewTicker(ss.TickInterval)
+	defer ticker.Stop()
+
+	for leftCh != nil || rightCh != nil {
+		select {
+		case <-ctx.Done():
+			lefts.release(fusion.Retry)
+			rights.release(fusion.Retry)
+			return
+
+		case <-ticker.C:
+
+		case msg, open := <-leftCh:
+			if !open {
+				leftCh = nil
+				continue
+			}
+			ss.add(ctx, lefts, rights, msg, true, out)
+
+		case msg, open := <-rightCh:
+			if !open {
+				rightCh = nil
+				continue
+			}
+			ss.add(ctx, rights, lefts, msg, false, out)
+		}
+
+		ss.expire(ctx, lefts, rights, time.Now().Add(-ss.Window), out)
+		metrics.Gauge("fusion_join_buffered", float64(lefts.len()), map[string]string{"side": "left"})
+		metrics.Gauge("fusion_join_buffered", float64(rights.len()), map[string]string{"side": "right"})
+	}
+
+	// both the streams ended. nothing more can match.
+	ss.expire(ctx, lefts, rights, time.Unix(0, math.MaxInt64), out)
+}
+
+// add joins the message with the matching messages of the other side and
+// buffers it.
+func (ss *StreamStream) add(ctx context.Context, own, other buffer, msg fusion.Msg, isLeft bool, out chan<- fusion.Msg) {
+	key := ss.RightKey(msg)
+	if isLeft {
+		key = ss.LeftKey(msg)
+	}
+
+	now := time.Now()
+	e := &entry{msg: msg, at: now, group: fusion.NewAckGroup(msg)}
+	for _, match := range other[key] {
+		if now.Sub(match.at) > ss.Window {
+			continue
+		}
+
+		left, right := e, match
+		if !isLeft {
+			left, right = match, e
+		}
+		ss.emit(ctx, key, left, right, out)
+	}
+	own[key] = append(own[key], e)
+}
+
+// emit sends the joined message of left and right. right is nil for the
+// unmatched left messages.
+func (ss *StreamStream) emit(ctx context.Context, key string, left, right *entry, out chan<- fusion.Msg) {
+	acks := []func(err error){left.group.Add(fusion.Msg{}).Ack}
+	var rightMsg *fusion.Msg
+	if right != nil {
+		left.matched, right.matched = true, true
+		acks = append(acks, right.group.Add(fusion.Msg{}).Ack)
+		rightMsg = &right.msg
+	}
+
+	ack := func(err error) {
+		for _, a := range acks {
+			a(err)
+		}
+	}
+	if res, ok := joined(ctx, ss.Combine, key, left.msg, rightMsg, ack); ok {
+		send(ctx, out, res)
+	}
+}
+
+// expire removes the messages that arrived before the cutoff from the buffers
+// and releases them.
+func (ss *StreamStream) expire(ctx context.Context, lefts, rights buffer, cutoff time.Time, out chan<- fusion.Msg) {
+	for _, e := range lefts.expire(cutoff) {
+		if !e.matched && ss.Type == Left {
+			ss.emit(ctx, ss.LeftKey(e.msg), e, nil, out)
+		}
+		e.group.Seal(fusion.Skip)
+	}
+
+	for _, e := range rights.expire(cutoff) {
+		e.group.Seal(fusion.Skip)
+	}
+}
+
+func (ss *StreamStream) init() error {
+	if ss.Left == nil || ss.Right == nil {
+		return errors.New("left and right streams must be set")
+	} else if ss.Window <= 0 {
+		return errors.New("window must be positive")
+	}
+	if ss.LeftKey == nil {
+		ss.LeftKey = msgKey
+	}
+	if ss.RightKey == nil {
+		ss.RightKey = msgKey
+	}
+	if ss.Combine == nil {
+		ss.Combine = JSONCombine
+	}
+	if ss.TickInterval <= 0 {
+		ss.TickInterval = 1 * time.Second
+	}
+	return nil
+}
+
+// expire removes and returns the entries that arrived before the cutoff.
+func (b buffer) expire(cutoff time.Time) []*entry {
+	var expired []*entry
+	for key, entries := range b {
+		i := 0
+		for i < len(entries) && entries[i].at.Before(cutoff) {
+			i++
+		}
+		expired = append(expired, entries[:i]...)
+
+		if i == len(entries) {
+			delete(b, key)
+		} else {
+			b[key] = entries[i:]
+		}
+	}
+
+	sort.SliceStable(expired, func(i, j int) bool { return expired[i].at.Before(expired[j].at) })
+	return expired
+}
+
+func (b buffer) release(err error) {
+	for key, entries := range b {
+		for _, e := range entries {
+			e.group.Seal(err)
+		}
+		delete(b, key)
+	}
+}
+
+func (b buffer) len() int {
+	n := 0
+	for _, entries := range b {
+		n += len(entries)
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package join_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/join"
+)
+
+func TestStreamStream_Out(t *testing.T) {
+	t.Parallel()
+
+	msg := func(acks *ackLog, id, key, side string) fusion.Msg {
+		return fusion.Msg{
+			Key:     []byte(key),
+			Val:     []byte(id),
+			Attribs: map[string]string{"side": side},
+			Ack:     acks.ack(id),
+		}
+	}
+
+	t.Run("NoWindow", func(t *testing.T) {
+		ss := &join.StreamStream{Left: chanStream(nil), Right: chanStream(nil)}
+		_, err := ss.Out(context.Background())
+		assert.Error(t, err)
+	})
+
+	t.Run("LeftJoin", func(t *testing.T) {
+		acks := &ackLog{}
+		lefts, rights := make(chan fusion.Msg), make(chan fusion.Msg)
+
+		ss := &join.StreamStream{
+			Left:   chanStream(lefts),
+			Right:  chanStream(rights),
+			Window: time.Hour,
+			Type:   join.Left,
+		}
+		out, err := ss.Out(context.Background())
+		require.NoError(t, err)
+
+		go func() {
+			lefts <- msg(acks, "l1", "k", "L")
+			rights <- msg(acks, "r1", "k", "R")
+			lefts <- msg(acks, "l2", "x", "L")
+			rights <- msg(acks, "r2", "y", "R")
+			rights <- msg(acks, "r3", "k", "R")
+			close(lefts)
+			close(rights)
+		}()
+
+		failR3 := func(msg fusion.Msg) error {
+			if strings.Contains(string(msg.Val), "r3") {
+				return fusion.Fail
+			}
+			return nil
+		}
+		assert.Equal(t, []string{
+			`k {"left":"l1","right":"r1"} side=L right.side=R`,
+			`k {"left":"l1","right":"r3"} side=L right.side=R`,
+			`x {"left":"l2","right":null} side=L`,
+		}, collect(out, failR3))
+		assert.Equal(t, map[string]error{
+			"l1": fusion.Fail, "r1": nil, "r3": fusion.Fail,
+			"l2": nil, "r2": fusion.Skip,
+		}, acks.get())
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		acks := &ackLog{}
+		lefts, rights := make(chan fusion.Msg), make(chan fusion.Msg)
+
+		ss := &join.StreamStream{
+			Left:         chanStream(lefts),
+			Right:        chanStream(rights),
+			Window:       20 * time.Millisecond,
+			TickInterval: 5 * time.Millisecond,
+		}
+		out, err := ss.Out(context.Background())
+		require.NoError(t, err)
+
+		go func() {
+			lefts <- msg(acks, "l1", "k", "L")
+			time.Sleep(60 * time.Millisecond)
+			rights <- msg(acks, "r1", "k", "R")
+			close(lefts)
+			close(rights)
+		}()
+
+		assert.Empty(t, collect(out, nil))
+		assert.Equal(t, map[string]error{"l1": fusion.Skip, "r1": fusion.Skip}, acks.get())
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		acks := &ackLog{}
+		lefts := make(chan fusion.Msg)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ss := &join.StreamStream{
+			Left:   chanStream(lefts),
+			Right:  chanStream(make(chan fusion.Msg)),
+			Window: time.Hour,
+		}
+		out, err := ss.Out(ctx)
+		require.NoError(t, err)
+
+		lefts <- msg(acks, "l1", "k", "L")
+		cancel()
+
+		assert.Empty(t, collect(out, nil))
+		assert.Equal(t, map[string]error{"l1": fusion.Retry}, acks.get())
+	})
+}
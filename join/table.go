@@ -0,0 +1,239 @@
+package join
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spy16/fusion"
+)
+
+var (
+	_ fusion.Stream  = (*StreamTable)(nil)
+	_ fusion.Flusher = (*StreamTable)(nil)
+)
+
+// StreamTable implements a fusion Stream that joins each message of Stream
+// with the latest message of the same key from Table. Table messages with
+// empty value delete the key (i.e., tombstones). Stream messages are joined
+// with the table as of their arrival and are not re-joined when the table
+// changes later. Stream is not read until the table has caught up (see
+// CatchUp), so that Stream messages are not skipped at startup for want of
+// rows that are yet to be loaded.
+//
+// Joined messages are acked to the Stream message. Table messages are held
+// until they are replaced by a newer message for the key and all the joined
+// messages using them are acked, after which they are acked with nil. This
+// ensures that the table is rebuilt from the un-acked messages after a
+// restart. Since the latest row of every key stays un-acked, commits on the
+// table source (e.g., Kafka offsets) never move past the oldest live row.
+// Table messages still held when ctx is cancelled or when Stream ends before
+// Table are nAcked with Retry.
+type StreamTable struct {
+	// Stream is the stream of messages to be enriched (left side).
+	Stream fusion.Stream
+
+	// Table is the stream of table updates keyed by Msg.Key (right side).
+	Table fusion.Stream
+
+	// KeyFunc returns the key of a Stream message to look up in the table.
+	// Defaults to Msg.Key. fusion.AttribKey can be used for joining on an
+	// attribute.
+	KeyFunc func(msg fusion.Msg) string
+
+	// Type of the join. Defaults to Inner.
+	Type Type
+
+	// Combine returns the value of the joined message. Defaults to
+	// JSONCombine.
+	Combine CombineFunc
+
+	// CatchUp is the duration for which no table messages must arrive for
+	// the table to be considered loaded at startup. Table is loaded until
+	// it ends if it ends sooner. Defaults to 1s.
+	CatchUp time.Duration
+}
+
+type row struct {
+	msg   fusion.Msg
+	group *fusion.AckGroup
+}
+
+// Out starts both the streams and returns the stream of joined messages. The
+// returned channel is closed when Stream ends or ctx is cancelled.
+func (st *StreamTable) Out(ctx context.Context) (<-chan fusion.Msg, error) {
+	if err := st.init(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	tableCh, err := st.Table.Out(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	streamCh, err := st.Stream.Out(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan fusion.Msg)
+	go func() {
+		defer cancel()
+		defer close(out)
+		st.join(ctx, streamCh, tableCh, out)
+	}()
+	return out, nil
+}
+
+// Flush flushes both the streams if they implement fusion.Flusher.
+func (st *StreamTable) Flush(ctx context.Context) error {
+	return flush(ctx, st.Stream, st.Table)
+}
+
+func (st *StreamTable) join(ctx context.Context, streamCh, tableCh <-chan fusion.Msg, out chan<- fusion.Msg) {
+	metrics := fusion.MetricsFrom(ctx)
+	rows := map[string]*row{}
+
+	release := func(err error) {
+		for key, r := range rows {
+			r.group.Seal(err)
+			delete(rows, key)
+		}
+	}
+
+	tableCh, loaded := st.load(ctx, rows, tableCh)
+	if !loaded {
+		release(fusion.Retry)
+		return
+	}
+	metrics.Gauge("fusion_join_table_rows", float64(len(rows)), nil)
+
+	for {
+		select {
+		case <-ctx.Done():
+			release(fusion.Retry)
+			return
+
+		case msg, open := <-tableCh:
+			if !open {
+				tableCh = nil
+				continue
+			}
+			st.update(rows, msg)
+			metrics.Gauge("fusion_join_table_rows", float64(len(rows)), nil)
+
+		case msg, open := <-streamCh:
+			if !open {
+				// rows are done only if the table has ended too. otherwise
+				// they must be replayed to rebuild the table after restart.
+				if st.catchUp(rows, tableCh) {
+					release(nil)
+				} else {
+					release(fusion.Retry)
+				}
+				return
+			}
+
+			key := st.KeyFunc(msg)
+			r, found := rows[key]
+			if !found {
+				if st.Type == Inner {
+					msg.Ack(fusion.Skip)
+				} else if res, ok := joined(ctx, st.Combine, key, msg, nil, msg.Ack); ok {
+					send(ctx, out, res)
+				}
+				continue
+			}
+
+			right := r.msg
+			child := r.group.Add(fusion.Msg{})
+			ack := func(err error) {
+				msg.Ack(err)
+				child.Ack(nil)
+			}
+			if res, ok := joined(ctx, st.Combine, key, msg, &right, ack); ok {
+				send(ctx, out, res)
+			}
+		}
+	}
+}
+
+// load applies the table messages until the table is idle for CatchUp or
+// ends. Returns the table channel (nil if it ended) and false if ctx was
+// cancelled before the table was loaded.
+func (st *StreamTable) load(ctx context.Context, rows map[string]*row, tableCh <-chan fusion.Msg) (<-chan fusion.Msg, bool) {
+	idle := time.NewTimer(st.CatchUp)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return tableCh, false
+
+		case <-idle.C:
+			return tableCh, true
+
+		case msg, open := <-tableCh:
+			if !open {
+				return nil, true
+			}
+			st.update(rows, msg)
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(st.CatchUp)
+		}
+	}
+}
+
+// catchUp applies the table messages that are ready without blocking and
+// returns true if the table has ended.
+func (st *StreamTable) catchUp(rows map[string]*row, tableCh <-chan fusion.Msg) bool {
+	for tableCh != nil {
+		select {
+		case msg, open := <-tableCh:
+			if !open {
+				return true
+			}
+			st.update(rows, msg)
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// update replaces the row of the key with the table message, releasing the
+// previous one.
+func (st *StreamTable) update(rows map[string]*row, msg fusion.Msg) {
+	key := msgKey(msg)
+	if prev, found := rows[key]; found {
+		prev.group.Seal(nil)
+		delete(rows, key)
+	}
+
+	if len(msg.Val) == 0 {
+		msg.Ack(nil)
+		return
+	}
+	rows[key] = &row{msg: msg, group: fusion.NewAckGroup(msg)}
+}
+
+func (st *StreamTable) init() error {
+	if st.Stream == nil || st.Table == nil {
+		return errors.New("stream and table must be set")
+	}
+	if st.KeyFunc == nil {
+		st.KeyFunc = msgKey
+	}
+	if st.Combine == nil {
+		st.Combine = JSONCombine
+	}
+	if st.CatchUp <= 0 {
+		st.CatchUp = 1 * time.Second
+	}
+	return nil
+}
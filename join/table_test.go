@@ -0,0 +1,245 @@
+package join_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/join"
+)
+
+func TestStreamTable_Out(t *testing.T) {
+	t.Parallel()
+
+	order := func(acks *ackLog, id, customer string) fusion.Msg {
+		return fusion.Msg{
+			Key:     []byte(id),
+			Val:     []byte(id),
+			Attribs: map[string]string{"customer": customer},
+			Ack:     acks.ack(id),
+		}
+	}
+	profile := func(acks *ackLog, customer, name string) fusion.Msg {
+		return fusion.Msg{
+			Key:     []byte(customer),
+			Val:     []byte(name),
+			Attribs: map[string]string{"source": "profiles"},
+			Ack:     acks.ack(customer + "=" + name),
+		}
+	}
+
+	t.Run("NoTable", func(t *testing.T) {
+		st := &join.StreamTable{Stream: chanStream(nil)}
+		_, err := st.Out(context.Background())
+		assert.Error(t, err)
+	})
+
+	table := []struct {
+		title string
+		typ   join.Type
+		want  []string
+	}{
+		{
+			title: "InnerJoin",
+			typ:   join.Inner,
+			want: []string{
+				`o1 {"left":"o1","right":"alice"} customer=c1 right.source=profiles`,
+				`o3 {"left":"o3","right":"alice2"} customer=c1 right.source=profiles`,
+			},
+		},
+		{
+			title: "LeftJoin",
+			typ:   join.Left,
+			want: []string{
+				`o1 {"left":"o1","right":"alice"} customer=c1 right.source=profiles`,
+				`o2 {"left":"o2","right":null} customer=c2`,
+				`o3 {"left":"o3","right":"alice2"} customer=c1 right.source=profiles`,
+				`o4 {"left":"o4","right":null} customer=c1`,
+			},
+		},
+	}
+
+	for _, tt := range table {
+		tt := tt
+		t.Run(tt.title, func(t *testing.T) {
+			acks := &ackLog{}
+			orders, profiles := make(chan fusion.Msg), make(chan fusion.Msg)
+
+			st := &join.StreamTable{
+				Stream:  chanStream(orders),
+				Table:   chanStream(profiles),
+				KeyFunc: fusion.AttribKey("customer"),
+				Type:    tt.typ,
+				CatchUp: 10 * time.Millisecond,
+			}
+			out, err := st.Out(context.Background())
+			require.NoError(t, err)
+
+			go func() {
+				profiles <- profile(acks, "c1", "alice")
+				orders <- order(acks, "o1", "c1")
+				orders <- order(acks, "o2", "c2")
+				profiles <- profile(acks, "c1", "alice2")
+				orders <- order(acks, "o3", "c1")
+				profiles <- profile(acks, "c1", "")
+				orders <- order(acks, "o4", "c1")
+				close(orders)
+			}()
+
+			assert.Equal(t, tt.want, collect(out, nil))
+
+			unmatched := fusion.Skip
+			if tt.typ == join.Left {
+				unmatched = nil
+			}
+			assert.Equal(t, map[string]error{
+				"o1": nil, "o2": unmatched, "o3": nil, "o4": unmatched,
+				"c1=alice": nil, "c1=alice2": nil, "c1=": nil,
+			}, acks.get())
+		})
+	}
+
+	t.Run("StreamEnded", func(t *testing.T) {
+		for _, tableEnded := range []bool{false, true} {
+			acks := &ackLog{}
+			orders, profiles := make(chan fusion.Msg), make(chan fusion.Msg)
+
+			st := &join.StreamTable{
+				Stream:  chanStream(orders),
+				Table:   chanStream(profiles),
+				KeyFunc: fusion.AttribKey("customer"),
+				CatchUp: 10 * time.Millisecond,
+			}
+			out, err := st.Out(context.Background())
+			require.NoError(t, err)
+
+			go func() {
+				profiles <- profile(acks, "c1", "alice")
+				if tableEnded {
+					close(profiles)
+				}
+				orders <- order(acks, "o1", "c1")
+				close(orders)
+			}()
+
+			assert.Len(t, collect(out, nil), 1)
+
+			var want error = fusion.Retry
+			if tableEnded {
+				want = nil
+			}
+			assert.Equal(t, map[string]error{"o1": nil, "c1=alice": want}, acks.get())
+		}
+	})
+
+	t.Run("TableLoadedFirst", func(t *testing.T) {
+		acks := &ackLog{}
+		orders, profiles := make(chan fusion.Msg, 1), make(chan fusion.Msg, 1)
+
+		// the order is ready before the table but must still be joined.
+		orders <- order(acks, "o1", "c1")
+		close(orders)
+		profiles <- profile(acks, "c1", "alice")
+		close(profiles)
+
+		st := &join.StreamTable{
+			Stream:  chanStream(orders),
+			Table:   chanStream(profiles),
+			KeyFunc: fusion.AttribKey("customer"),
+		}
+		out, err := st.Out(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			`o1 {"left":"o1","right":"alice"} customer=c1 right.source=profiles`,
+		}, collect(out, nil))
+		assert.Equal(t, map[string]error{"o1": nil, "c1=alice": nil}, acks.get())
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		acks := &ackLog{}
+		profiles := make(chan fusion.Msg)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		st := &join.StreamTable{
+			Stream: chanStream(make(chan fusion.Msg)),
+			Table:  chanStream(profiles),
+		}
+		out, err := st.Out(ctx)
+		require.NoError(t, err)
+
+		profiles <- profile(acks, "c1", "alice")
+		cancel()
+
+		assert.Empty(t, collect(out, nil))
+		assert.Equal(t, map[string]error{"c1=alice": fusion.Retry}, acks.get())
+	})
+}
+
+// chanStream returns a Stream that emits the messages sent to ch.
+func chanStream(ch chan fusion.Msg) fusion.Stream {
+	return streamFn(func(ctx context.Context) (<-chan fusion.Msg, error) {
+		if ch == nil {
+			return nil, errors.New("no stream")
+		}
+		return ch, nil
+	})
+}
+
+type streamFn func(ctx context.Context) (<-chan fusion.Msg, error)
+
+func (fn streamFn) Out(ctx context.Context) (<-chan fusion.Msg, error) { return fn(ctx) }
+
+// collect reads the joined messages until out is closed, acks them with the
+// error returned by ackWith (nil if not set) and returns them as strings.
+func collect(out <-chan fusion.Msg, ackWith func(msg fusion.Msg) error) []string {
+	var res []string
+	for msg := range out {
+		s := string(msg.Key) + " " + string(msg.Val)
+		for _, k := range []string{"customer", "right.source", "side", "right.side"} {
+			if v, found := msg.Attribs[k]; found {
+				s += " " + k + "=" + v
+			}
+		}
+		res = append(res, s)
+
+		var err error
+		if ackWith != nil {
+			err = ackWith(msg)
+		}
+		msg.Ack(err)
+	}
+	return res
+}
+
+type ackLog struct {
+	mu   sync.Mutex
+	acks map[string]error
+}
+
+func (al *ackLog) ack(id string) func(err error) {
+	return func(err error) {
+		al.mu.Lock()
+		defer al.mu.Unlock()
+		if al.acks == nil {
+			al.acks = map[string]error{}
+		}
+		al.acks[id] = err
+	}
+}
+
+func (al *ackLog) get() map[string]error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	res := map[string]error{}
+	for k, v := range al.acks {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+package fusion
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Log levels used by the leveled helpers of Log.
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Log implementation provides structured logging facilities for fusion
+// components. Every entry has "level" and "message" fields along with any
+// contextual fields attached using With.
+type Log func(_ map[string]interface{})
+
+// Debugf logs a formatted message at debug level.
+func (l Log) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+
+// Infof logs a formatted message at info level.
+func (l Log) Infof(format string, args ...interface{}) { l.logf(LevelInfo, format, args...) }
+
+// Warnf logs a formatted message at warn level.
+func (l Log) Warnf(format string, args ...interface{}) { l.logf(LevelWarn, format, args...) }
+
+// Errorf logs a formatted message at error level.
+func (l Log) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+// With returns a Log that adds the given fields to every entry. Fields set
+// on the entry itself take precedence.
+func (l Log) With(fields map[string]interface{}) Log {
+	if len(fields) == 0 {
+		return l
+	}
+	return func(entry map[string]interface{}) {
+		merged := make(map[string]interface{}, len(fields)+len(entry))
+		for k, v := range fields {
+			merged[k] = v
+		}
+		for k, v := range entry {
+			merged[k] = v
+		}
+		l(merged)
+	}
+}
+
+// Sample returns a Log that writes only the first of every n entries. This
+// is meant for hot paths (e.g., per-message warnings) where logging every
+// occurrence would flood the backend. Entries that get through carry the
+// number of entries dropped since the previous one as "sampled".
+func (l Log) Sample(n int) Log {
+	if n <= 1 {
+		return l
+	}
+	var count int64
+	return func(entry map[string]interface{}) {
+		c := atomic.AddInt64(&count, 1)
+		if (c-1)%int64(n) != 0 {
+			return
+		}
+		if c > 1 {
+			entry = withField(entry, "sampled", n-1)
+		}
+		l(entry)
+	}
+}
+
+func (l Log) logf(level, format string, args ...interface{}) {
+	l(map[string]interface{}{
+		"level":   level,
+		"message": fmt.Sprintf(format, args...),
+	})
+}
+
+// WithLogFields returns a ctx in which the Log returned by LogFrom adds the
+// given fields to every entry. Procs use this to attach per-message fields
+// (e.g., worker id, message key) to everything logged while processing it.
+func WithLogFields(ctx context.Context, fields map[string]interface{}) context.Context {
+	return withLog(ctx, LogFrom(ctx).With(fields))
+}
+
+// SugaredLogger is implemented by zap-style loggers that accept loosely
+// typed key-value pairs (e.g., *zap.SugaredLogger).
+type SugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// SugaredLog returns a Log that writes to the zap-style logger. Unknown
+// levels are written at info level.
+func SugaredLog(sl SugaredLogger) Log {
+	return func(entry map[string]interface{}) {
+		level, msg, fields := splitEntry(entry)
+		kvs := make([]interface{}, 0, 2*len(fields))
+		for k, v := range fields {
+			kvs = append(kvs, k, v)
+		}
+
+		switch level {
+		case LevelDebug:
+			sl.Debugw(msg, kvs...)
+		case LevelWarn:
+			sl.Warnw(msg, kvs...)
+		case LevelError, "fatal":
+			sl.Errorw(msg, kvs...)
+		default:
+			sl.Infow(msg, kvs...)
+		}
+	}
+}
+
+// FieldsLog returns a Log that invokes fn with the level, message and the
+// remaining fields of every entry. This can be used to plug in logrus-style
+// loggers that take a map of fields. For example:
+//
+//	fusion.FieldsLog(func(level, msg string, fields map[string]interface{}) {
+//		lvl, _ := logrus.ParseLevel(level)
+//		logger.WithFields(fields).Log(lvl, msg)
+//	})
+func FieldsLog(fn func(level, msg string, fields map[string]interface{})) Log {
+	return func(entry map[string]interface{}) {
+		fn(splitEntry(entry))
+	}
+}
+
+// splitEntry separates level and message from the rest of the fields in a
+// log entry. Level defaults to info if not set.
+func splitEntry(entry map[string]interface{}) (level, msg string, fields map[string]interface{}) {
+	level, msg = LevelInfo, ""
+	fields = make(map[string]interface{}, len(entry))
+	for k, v := range entry {
+		switch k {
+		case "level":
+			level = fmt.Sprint(v)
+		case "message":
+			msg = fmt.Sprint(v)
+		default:
+			fields[k] = v
+		}
+	}
+	return level, msg, fields
+}
+
+func withField(entry map[string]interface{}, key string, val interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(entry)+1)
+	for k, v := range entry {
+		res[k] = v
+	}
+	res[key] = val
+	return res
+}
@@ -0,0 +1,35 @@
+//go:build go1.21
+// +build go1.21
+
+package fusion
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLog returns a Log that writes to the given log/slog logger. Unknown
+// levels are written at info level.
+func SlogLog(logger *slog.Logger) Log {
+	return func(entry map[string]interface{}) {
+		level, msg, fields := splitEntry(entry)
+		attrs := make([]slog.Attr, 0, len(fields))
+		for k, v := range fields {
+			attrs = append(attrs, slog.Any(k, v))
+		}
+		logger.LogAttrs(context.Background(), slogLevel(level), msg, attrs...)
+	}
+}
+
+func slogLevel(level string) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError, "fatal":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,34 @@
+//go:build go1.21
+// +build go1.21
+
+package fusion_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/fusion"
+)
+
+func TestSlogLog(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	log := fusion.SlogLog(logger)
+	log.With(map[string]interface{}{"worker": 1}).Warnf("failed: %d", 10)
+	log.Debugf("not logged at default level")
+
+	assert.Equal(t, "level=WARN msg=\"failed: 10\" worker=1\n", buf.String())
+}
@@ -0,0 +1,133 @@
+package fusion_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestLog(t *testing.T) {
+	t.Parallel()
+
+	var entries []map[string]interface{}
+	log := fusion.Log(func(entry map[string]interface{}) {
+		entries = append(entries, entry)
+	})
+
+	log.With(map[string]interface{}{"worker": 1, "message": "overridden"}).Warnf("failed: %v", "x")
+	log.Debugf("debug")
+	log.With(nil).Errorf("error")
+
+	assert.Equal(t, []map[string]interface{}{
+		{"level": "warn", "message": "failed: x", "worker": 1},
+		{"level": "debug", "message": "debug"},
+		{"level": "error", "message": "error"},
+	}, entries)
+}
+
+func TestLog_Sample(t *testing.T) {
+	t.Parallel()
+
+	var entries []map[string]interface{}
+	log := fusion.Log(func(entry map[string]interface{}) {
+		entries = append(entries, entry)
+	}).Sample(3)
+
+	for i := 0; i < 7; i++ {
+		log.Infof("entry %d", i)
+	}
+
+	require.Len(t, entries, 3)
+	assert.Equal(t, "entry 0", entries[0]["message"])
+	assert.Nil(t, entries[0]["sampled"])
+	assert.Equal(t, "entry 3", entries[1]["message"])
+	assert.Equal(t, 2, entries[1]["sampled"])
+	assert.Equal(t, "entry 6", entries[2]["message"])
+}
+
+func TestSugaredLog(t *testing.T) {
+	t.Parallel()
+
+	sl := &fakeSugared{}
+	log := fusion.SugaredLog(sl)
+	log.With(map[string]interface{}{"worker": 1}).Warnf("warning")
+	log(map[string]interface{}{"message": "no level"})
+
+	assert.Equal(t, []string{
+		"warn: warning [worker 1]",
+		"info: no level []",
+	}, sl.lines)
+}
+
+func TestFieldsLog(t *testing.T) {
+	t.Parallel()
+
+	var got []string
+	log := fusion.FieldsLog(func(level, msg string, fields map[string]interface{}) {
+		got = append(got, fmt.Sprintf("%s: %s %v", level, msg, fields))
+	})
+	log.With(map[string]interface{}{"worker": 1}).Errorf("failed")
+
+	assert.Equal(t, []string{"error: failed map[worker:1]"}, got)
+}
+
+func TestFn_Run_LogFields(t *testing.T) {
+	mu := &sync.Mutex{}
+	var entries []map[string]interface{}
+
+	sent := false
+	runner := fusion.Runner{
+		Log: func(entry map[string]interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			entries = append(entries, entry)
+		},
+		Stream: fusion.StreamFn(func(ctx context.Context) (*fusion.Msg, error) {
+			if sent {
+				return nil, context.Canceled
+			}
+			sent = true
+			return &fusion.Msg{
+				Key:     []byte("k1"),
+				Attribs: map[string]string{"partition": "3", "other": "x"},
+				Ack:     func(_ error) {},
+			}, nil
+		}),
+		Proc: &fusion.Fn{
+			Workers: 1,
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				fusion.LogFrom(ctx).Infof("processing")
+				return nil
+			},
+		},
+	}
+	require.NoError(t, runner.Run(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, entries)
+	assert.Equal(t, map[string]interface{}{
+		"level":     "info",
+		"message":   "processing",
+		"worker":    0,
+		"msg_key":   "k1",
+		"partition": "3",
+	}, entries[0])
+}
+
+type fakeSugared struct{ lines []string }
+
+func (fs *fakeSugared) Debugw(msg string, kvs ...interface{}) { fs.add("debug", msg, kvs) }
+func (fs *fakeSugared) Infow(msg string, kvs ...interface{})  { fs.add("info", msg, kvs) }
+func (fs *fakeSugared) Warnw(msg string, kvs ...interface{})  { fs.add("warn", msg, kvs) }
+func (fs *fakeSugared) Errorw(msg string, kvs ...interface{}) { fs.add("error", msg, kvs) }
+
+func (fs *fakeSugared) add(level, msg string, kvs []interface{}) {
+	fs.lines = append(fs.lines, fmt.Sprintf("%s: %s %v", level, msg, kvs))
+}
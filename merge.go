@@ -0,0 +1,181 @@
+package fusion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	_ Stream  = (*Merge)(nil)
+	_ Flusher = (*Merge)(nil)
+)
+
+// SourceAttrib is the attribute set by Merge on each message to the name of
+// the source it came from.
+const SourceAttrib = "source"
+
+// Source is a named Stream to be merged using Merge.
+type Source struct {
+	// Name of the source. Must be unique within the Merge.
+	Name string
+
+	// Stream to read the messages from.
+	Stream Stream
+
+	// Weight is the number of messages taken from the source in each round
+	// when multiple sources have messages ready. Defaults to 1.
+	Weight int
+}
+
+// Merge implements a Stream that combines the messages of multiple Streams
+// into one. Each message is tagged with the name of its source in Attribs
+// as SourceAttrib. When multiple sources have messages ready, they are
+// interleaved in rounds by their weights (i.e., in proportion to the weights
+// or fairly if the weights are equal). The merged stream is closed when all
+// the sources close or ctx is cancelled.
+type Merge struct {
+	Sources []Source
+}
+
+// Out starts all the sources and returns the merged stream. If any of the
+// sources fails to start, the others are stopped and the error is returned.
+func (m *Merge) Out(ctx context.Context) (<-chan Msg, error) {
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	chans := make([]<-chan Msg, len(m.Sources))
+	for i, src := range m.Sources {
+		ch, err := src.Stream.Out(ctx)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("source '%s': %w", src.Name, err)
+		}
+		chans[i] = ch
+	}
+
+	out := make(chan Msg)
+	go func() {
+		defer cancel()
+		defer close(out)
+		m.merge(ctx, chans, out)
+	}()
+	return out, nil
+}
+
+// Flush flushes all the sources that implement the Flusher interface and
+// returns the first error.
+func (m *Merge) Flush(ctx context.Context) error {
+	var firstErr error
+	for _, src := range m.Sources {
+		if f, ok := src.Stream.(Flusher); ok {
+			if err := f.Flush(ctx); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("source '%s': %w", src.Name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func (m *Merge) merge(ctx context.Context, chans []<-chan Msg, out chan<- Msg) {
+	metrics := MetricsFrom(ctx)
+	open := len(chans)
+
+	// forward tags the message with the source and sends it to out. Returns
+	// false if ctx was cancelled.
+	forward := func(i int, msg Msg) bool {
+		attribs := make(map[string]string, len(msg.Attribs)+1)
+		for k, v := range msg.Attribs {
+			attribs[k] = v
+		}
+		attribs[SourceAttrib] = m.Sources[i].Name
+		msg.Attribs = attribs
+
+		metrics.Count("fusion_merge_messages_total", 1, map[string]string{"source": m.Sources[i].Name})
+		select {
+		case <-ctx.Done():
+			msg.Ack(Retry)
+			return false
+		case out <- msg:
+			return true
+		}
+	}
+
+	for open > 0 {
+		// take up to weight messages that are ready from each source.
+		progressed := false
+		for i := range chans {
+			for n := 0; n < m.Sources[i].Weight && chans[i] != nil; n++ {
+				msg, ready, isOpen := poll(chans[i])
+				if !ready {
+					break
+				} else if !isOpen {
+					chans[i] = nil
+					open--
+					progressed = true
+					break
+				}
+
+				if !forward(i, msg) {
+					return
+				}
+				progressed = true
+			}
+		}
+		if progressed {
+			continue
+		}
+
+		// none of the sources have messages ready. wait for any.
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}}
+		for _, ch := range chans {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+		}
+
+		chosen, val, ok := reflect.Select(cases)
+		if chosen == 0 {
+			return
+		} else if !ok {
+			chans[chosen-1] = nil
+			open--
+		} else if !forward(chosen-1, val.Interface().(Msg)) {
+			return
+		}
+	}
+}
+
+func (m *Merge) init() error {
+	if len(m.Sources) == 0 {
+		return errors.New("at least one source must be set")
+	}
+
+	names := map[string]bool{}
+	for i := range m.Sources {
+		src := &m.Sources[i]
+		if src.Name == "" || src.Stream == nil {
+			return fmt.Errorf("source %d: name and stream must be set", i)
+		} else if names[src.Name] {
+			return fmt.Errorf("source '%s': duplicate name", src.Name)
+		}
+		names[src.Name] = true
+
+		if src.Weight <= 0 {
+			src.Weight = 1
+		}
+	}
+	return nil
+}
+
+// poll receives from the channel without blocking. ready is false if there is
+// no message and open is false if the channel is closed.
+func poll(ch <-chan Msg) (msg Msg, ready, open bool) {
+	select {
+	case msg, open = <-ch:
+		return msg, true, open
+	default:
+		return Msg{}, false, true
+	}
+}
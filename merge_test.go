@@ -0,0 +1,96 @@
+package fusion_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestMerge_Out(t *testing.T) {
+	t.Parallel()
+
+	msgs := func(vals ...string) <-chan fusion.Msg {
+		var messages []fusion.Msg
+		for _, v := range vals {
+			messages = append(messages, fusion.Msg{Val: []byte(v), Ack: func(_ error) {}})
+		}
+		return msgStream(messages...)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := (&fusion.Merge{}).Out(context.Background())
+		assert.Error(t, err)
+
+		_, err = (&fusion.Merge{Sources: []fusion.Source{
+			{Name: "a", Stream: chanStream(msgs())},
+			{Name: "a", Stream: chanStream(msgs())},
+		}}).Out(context.Background())
+		assert.Error(t, err)
+	})
+
+	t.Run("SourceError", func(t *testing.T) {
+		m := &fusion.Merge{Sources: []fusion.Source{
+			{Name: "a", Stream: chanStream(msgs())},
+			{Name: "c", Stream: errStream{}},
+		}}
+		_, err := m.Out(context.Background())
+		assert.EqualError(t, err, "source 'c': failed")
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		m := &fusion.Merge{Sources: []fusion.Source{
+			{Name: "a", Stream: chanStream(msgs("a1", "a2", "a3", "a4", "a5")), Weight: 2},
+			{Name: "b", Stream: chanStream(msgs("b1", "b2", "b3", "b4"))},
+		}}
+		out, err := m.Out(context.Background())
+		require.NoError(t, err)
+
+		var got []string
+		for msg := range out {
+			assert.Equal(t, msg.Attribs[fusion.SourceAttrib], string(msg.Val[:1]))
+			got = append(got, string(msg.Val))
+		}
+		assert.Equal(t, []string{"a1", "a2", "b1", "a3", "a4", "b2", "a5", "b3", "b4"}, got)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		m := &fusion.Merge{Sources: []fusion.Source{
+			{Name: "a", Stream: chanStream(msgs("a1"))},
+			{Name: "b", Stream: chanStream(make(chan fusion.Msg))},
+		}}
+		out, err := m.Out(ctx)
+		require.NoError(t, err)
+
+		msg := <-out
+		assert.Equal(t, map[string]string{fusion.SourceAttrib: "a"}, msg.Attribs)
+
+		// b is still open.
+		select {
+		case <-out:
+			t.Fatal("merged stream must not close while a source is open")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		cancel()
+		_, open := <-out
+		assert.False(t, open)
+	})
+}
+
+// chanStream returns a Stream that emits the messages from ch.
+func chanStream(ch <-chan fusion.Msg) fusion.Stream { return msgChanStream{ch: ch} }
+
+type msgChanStream struct{ ch <-chan fusion.Msg }
+
+func (s msgChanStream) Out(_ context.Context) (<-chan fusion.Msg, error) { return s.ch, nil }
+
+type errStream struct{}
+
+func (errStream) Out(_ context.Context) (<-chan fusion.Msg, error) { return nil, errors.New("failed") }
@@ -0,0 +1,54 @@
+package fusion
+
+import "context"
+
+var metricsKey = ctxKey("metrics")
+
+// Metrics implementation provides instrumentation facilities for fusion
+// components. Names follow Prometheus conventions (e.g., with _total suffix
+// for counters and _seconds suffix for durations). Tags may be nil.
+type Metrics interface {
+	// Count adds delta to the counter identified by name and tags.
+	Count(name string, delta float64, tags map[string]string)
+
+	// Gauge sets the current value of the gauge identified by name and tags.
+	Gauge(name string, value float64, tags map[string]string)
+
+	// Observe records the value in the histogram identified by name and tags.
+	Observe(name string, value float64, tags map[string]string)
+}
+
+// MetricsFrom extracts metrics set by fusion Runner from the context. Returns
+// a no-op implementation if not set.
+func MetricsFrom(ctx context.Context) Metrics {
+	m, ok := ctx.Value(metricsKey).(Metrics)
+	if !ok || m == nil {
+		return noOpMetrics{}
+	}
+	return m
+}
+
+func withMetrics(ctx context.Context, m Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey, m)
+}
+
+// ResultLabel returns the metric tag value to be used for the given ack
+// error: one of success, skip, fail or retry.
+func ResultLabel(err error) string {
+	switch err {
+	case nil:
+		return "success"
+	case Skip:
+		return "skip"
+	case Fail:
+		return "fail"
+	default:
+		return "retry"
+	}
+}
+
+type noOpMetrics struct{}
+
+func (noOpMetrics) Count(_ string, _ float64, _ map[string]string)   {}
+func (noOpMetrics) Gauge(_ string, _ float64, _ map[string]string)   {}
+func (noOpMetrics) Observe(_ string, _ float64, _ map[string]string) {}
@@ -1,6 +1,9 @@
 package fusion
 
-import "errors"
+import (
+	"errors"
+	"sync"
+)
 
 var (
 	// Skip can be passed as argument to the Ack method of Msg to signal
@@ -26,7 +29,7 @@ type Msg struct {
 	// through the pipeline. A no-op value must be set when there is
 	// no need for ack. Ack must be idempotent. If message was handled
 	// successfully, then Ack will be called without error.
-	Ack func(err error)
+	Ack func(err error) `json:"-"`
 }
 
 // Clone returns a clone of the original message. Ack function will
@@ -35,6 +38,122 @@ func (msg *Msg) Clone() Msg {
 	var clone Msg
 	clone.Key = append([]byte(nil), msg.Key...)
 	clone.Val = append([]byte(nil), msg.Val...)
+	if msg.Attribs != nil {
+		clone.Attribs = make(map[string]string, len(msg.Attribs))
+		for k, v := range msg.Attribs {
+			clone.Attribs[k] = v
+		}
+	}
 	clone.Ack = func(_ error) {}
 	return clone
 }
+
+// Derive returns a clone of the message whose Ack is propagated to the
+// original message. Same as Split(1)[0].
+func (msg *Msg) Derive() Msg { return msg.Split(1)[0] }
+
+// Split returns n clones of the message. Original message is acked once all
+// the clones are acked. If all the clones succeed, original is acked with nil.
+// Otherwise, original is acked with the error with highest precedence: Retry
+// (or any unknown error) over Fail over nil. Skip is used only if all the
+// clones were acked with Skip.
+func (msg *Msg) Split(n int) []Msg {
+	group := NewAckGroup(*msg)
+	children := make([]Msg, n)
+	for i := range children {
+		children[i] = group.Add(msg.Clone())
+	}
+	group.Seal(nil)
+	return children
+}
+
+// AckGroup aggregates the acks of messages derived from a parent message.
+// Unlike Split, number of children need not be known upfront. Parent is acked
+// once the group is sealed and all the children are acked. See Split for the
+// precedence rules.
+type AckGroup struct {
+	mu      sync.Mutex
+	ack     func(err error)
+	pending int
+	sealed  bool
+	voted   bool
+	err     error
+}
+
+// NewAckGroup returns a new group that acks the parent message.
+func NewAckGroup(parent Msg) *AckGroup {
+	ack := parent.Ack
+	if ack == nil {
+		ack = func(_ error) {}
+	}
+	return &AckGroup{ack: ack}
+}
+
+// Add adds the child to the group and returns it with the Ack set. Add must
+// not be called after Seal.
+func (g *AckGroup) Add(child Msg) Msg {
+	g.mu.Lock()
+	g.pending++
+	g.mu.Unlock()
+
+	once := &sync.Once{}
+	child.Ack = func(err error) {
+		once.Do(func() {
+			g.mu.Lock()
+			g.pending--
+			g.vote(err)
+			g.mu.Unlock()
+			g.maybeAck()
+		})
+	}
+	return child
+}
+
+// Seal marks that no more children will be added to the group. If err is
+// not nil, it is merged into the result as if it was the ack of a child.
+// If the group has no children, parent is acked immediately.
+func (g *AckGroup) Seal(err error) {
+	g.mu.Lock()
+	g.sealed = true
+	if err != nil {
+		g.vote(err)
+	}
+	g.mu.Unlock()
+	g.maybeAck()
+}
+
+func (g *AckGroup) vote(err error) {
+	if !g.voted || ackRank(err) > ackRank(g.err) {
+		g.err = err
+	}
+	g.voted = true
+}
+
+func (g *AckGroup) maybeAck() {
+	g.mu.Lock()
+	done := g.sealed && g.pending == 0 && g.ack != nil
+	ack, err := g.ack, g.err
+	if done {
+		g.ack = nil
+	}
+	g.mu.Unlock()
+
+	if done {
+		ack(err)
+	}
+}
+
+// ackRank decides the precedence of ack errors when merging acks of multiple
+// messages.
+func ackRank(err error) int {
+	switch err {
+	case Skip:
+		return 0
+	case nil:
+		return 1
+	case Fail:
+		return 2
+	default:
+		return 3
+	}
+}
@@ -29,3 +29,66 @@ func TestMessage_Clone(t *testing.T) {
 	clone.Ack(nil) // ack should not affect originalAck
 	assert.False(t, originalAck)
 }
+
+func TestMsg_Split(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		title string
+		acks  []error
+		want  error
+	}{
+		{title: "AllSuccess", acks: []error{nil, nil, nil}, want: nil},
+		{title: "SkipAndSuccess", acks: []error{fusion2.Skip, nil}, want: nil},
+		{title: "AllSkipped", acks: []error{fusion2.Skip, fusion2.Skip}, want: fusion2.Skip},
+		{title: "FailAndSuccess", acks: []error{nil, fusion2.Fail, nil}, want: fusion2.Fail},
+		{title: "RetryOverFail", acks: []error{fusion2.Fail, fusion2.Retry, nil}, want: fusion2.Retry},
+	}
+
+	for _, tt := range table {
+		tt := tt
+		t.Run(tt.title, func(t *testing.T) {
+			acked := 0
+			var got error
+			msg := fusion2.Msg{
+				Key:     []byte("key"),
+				Attribs: map[string]string{"a": "b"},
+				Ack: func(err error) {
+					acked++
+					got = err
+				},
+			}
+
+			children := msg.Split(len(tt.acks))
+			for i, child := range children {
+				assert.Equal(t, msg.Key, child.Key)
+				assert.Equal(t, msg.Attribs, child.Attribs)
+				assert.Equal(t, 0, acked, "parent must not be acked before all children")
+				child.Ack(tt.acks[i])
+				child.Ack(fusion2.Retry) // must be idempotent.
+			}
+			assert.Equal(t, 1, acked)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAckGroup(t *testing.T) {
+	var acked []error
+	group := fusion2.NewAckGroup(fusion2.Msg{
+		Ack: func(err error) { acked = append(acked, err) },
+	})
+
+	child := group.Add(fusion2.Msg{Val: []byte("child")})
+	child.Ack(nil)
+	assert.Empty(t, acked, "parent must not be acked before Seal")
+
+	group.Seal(fusion2.Fail)
+	assert.Equal(t, []error{fusion2.Fail}, acked)
+
+	empty := fusion2.NewAckGroup(fusion2.Msg{
+		Ack: func(err error) { acked = append(acked, err) },
+	})
+	empty.Seal(nil)
+	assert.Equal(t, []error{fusion2.Fail, nil}, acked)
+}
@@ -0,0 +1,79 @@
+package fusion
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrTooManyPanics is returned by Fn when the panic circuit trips.
+var ErrTooManyPanics = errors.New("too many panics")
+
+// PanicError is the error recovered from a panic along with the stack trace
+// of the panicking goroutine.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (pe PanicError) Error() string { return fmt.Sprintf("panic: %v", pe.Value) }
+
+// recovered converts the value recovered from a panic to PanicError. Must be
+// called from the deferred function so that the stack is of the panic.
+func recovered(v interface{}) PanicError {
+	return PanicError{Value: v, Stack: debug.Stack()}
+}
+
+// panicCircuit trips when more than max panics occur within a minute. Zero
+// max disables the circuit.
+type panicCircuit struct {
+	max int
+
+	mu      sync.Mutex
+	panics  []time.Time
+	once    sync.Once
+	tripped chan struct{}
+}
+
+func newPanicCircuit(max int) *panicCircuit {
+	return &panicCircuit{max: max, tripped: make(chan struct{})}
+}
+
+// record records a panic at t and returns true if this trips the circuit.
+func (pc *panicCircuit) record(t time.Time) bool {
+	if pc.max <= 0 {
+		return false
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	recent := pc.panics[:0]
+	for _, at := range pc.panics {
+		if t.Sub(at) < time.Minute {
+			recent = append(recent, at)
+		}
+	}
+	pc.panics = append(recent, t)
+
+	if len(pc.panics) <= pc.max {
+		return false
+	}
+	trips := false
+	pc.once.Do(func() {
+		close(pc.tripped)
+		trips = true
+	})
+	return trips
+}
+
+func (pc *panicCircuit) isOpen() bool {
+	select {
+	case <-pc.tripped:
+		return true
+	default:
+		return false
+	}
+}
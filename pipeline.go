@@ -0,0 +1,143 @@
+package fusion
+
+import (
+	"context"
+	"sync"
+)
+
+var _ Proc = (*Pipeline)(nil)
+
+// Pipeline implements a Proc by chaining one or more stages. Messages emitted
+// by a stage become the input of the next stage and the messages emitted by
+// the last stage are consumed by the Sink. A message from the stream is acked
+// only after all the messages derived from it have been acked by the Sink.
+type Pipeline struct {
+	// Stages to run in order. Pipeline with no stages simply forwards the
+	// stream to the Sink.
+	Stages []Stage
+
+	// Sink is the Proc that consumes the messages emitted by the last stage.
+	// If not set, messages reaching the end of the pipeline are acked with
+	// nil error.
+	Sink Proc
+}
+
+// Stage represents a step in the Pipeline.
+type Stage struct {
+	// Number of worker threads to launch for this stage. If not set,
+	// defaults to 1.
+	Workers int
+
+	// Func is invoked for each message that reaches this stage. Func can
+	// call emit zero or more times to send messages to the next stage. If
+	// Func returns error, the input message is acked with it once all the
+	// emitted messages are acked. If not set, messages are forwarded as is.
+	Func func(ctx context.Context, msg Msg, emit Emit) error
+}
+
+// Emit is used by pipeline stages to send messages to the next stage. Ack
+// function of the emitted message is replaced and need not be set.
+type Emit func(msg Msg)
+
+// Run launches the workers for all the stages and the sink and blocks until
+// all of them exit. Returns the error returned by the Sink.
+func (p *Pipeline) Run(ctx context.Context, stream <-chan Msg) error {
+	sink := p.Sink
+	if sink == nil {
+		sink = ProcFn(func(_ context.Context, stream <-chan Msg) error {
+			for msg := range stream {
+				msg.Ack(nil)
+			}
+			return nil
+		})
+	}
+
+	if len(p.Stages) == 0 {
+		return sink.Run(ctx, stream)
+	}
+
+	return Feed(ctx, sink, func(ctx context.Context, out chan<- Msg) {
+		p.runStages(ctx, stream, out)
+	})
+}
+
+// runStages runs the stages chained from in to out and blocks until all of
+// them exit.
+func (p *Pipeline) runStages(ctx context.Context, in <-chan Msg, out chan<- Msg) {
+	wg := &sync.WaitGroup{}
+	for i, st := range p.Stages {
+		var next chan Msg
+		stageOut := out
+		if i < len(p.Stages)-1 {
+			next = make(chan Msg)
+			stageOut = next
+		}
+
+		wg.Add(1)
+		go func(st Stage, in <-chan Msg, out chan<- Msg, closeOut bool) {
+			defer wg.Done()
+			st.run(ctx, in, out)
+			if closeOut {
+				close(out)
+			}
+		}(st, in, stageOut, next != nil)
+		in = next
+	}
+	wg.Wait()
+}
+
+func (st Stage) run(ctx context.Context, in <-chan Msg, out chan<- Msg) {
+	if st.Func == nil {
+		st.Func = func(_ context.Context, msg Msg, emit Emit) error {
+			emit(msg)
+			return nil
+		}
+	}
+	if st.Workers <= 0 {
+		st.Workers = 1
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < st.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				var msg Msg
+				select {
+				case <-ctx.Done():
+					return
+				case m, open := <-in:
+					if !open {
+						return
+					}
+					msg = m
+				}
+
+				msgCtx, span := startSpan(ctx, "fusion.stage", msg)
+				if span != nil {
+					ack := msg.Ack
+					msg.Ack = func(err error) {
+						span.End(err)
+						ack(err)
+					}
+				}
+
+				group := NewAckGroup(msg)
+				err := st.Func(msgCtx, msg, func(child Msg) {
+					child = group.Add(child)
+					InjectTrace(msgCtx, &child)
+
+					select {
+					case <-ctx.Done():
+						child.Ack(Retry)
+					case out <- child:
+					}
+				})
+				group.Seal(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
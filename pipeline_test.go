@@ -0,0 +1,142 @@
+package fusion_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestPipeline_Run(t *testing.T) {
+	t.Parallel()
+
+	split := fusion.Stage{
+		Workers: 2,
+		Func: func(ctx context.Context, msg fusion.Msg, emit fusion.Emit) error {
+			for _, word := range bytes.Fields(msg.Val) {
+				emit(fusion.Msg{Key: msg.Key, Val: word})
+			}
+			return nil
+		},
+	}
+
+	t.Run("NoStages", func(t *testing.T) {
+		var acked []error
+		p := &fusion.Pipeline{}
+		err := p.Run(context.Background(), msgStream(fusion.Msg{
+			Ack: func(err error) { acked = append(acked, err) },
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, []error{nil}, acked)
+	})
+
+	t.Run("FanOut", func(t *testing.T) {
+		mu := sync.Mutex{}
+		var words []string
+		acks := map[string]error{}
+		ackAs := func(key string) func(err error) {
+			return func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				acks[key] = err
+			}
+		}
+
+		p := &fusion.Pipeline{
+			Stages: []fusion.Stage{split, {}},
+			Sink: &fusion.Fn{
+				Workers: 3,
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					mu.Lock()
+					defer mu.Unlock()
+					words = append(words, string(msg.Val))
+					if string(msg.Val) == "bad" {
+						return fusion.Retry
+					}
+					return nil
+				},
+			},
+		}
+
+		err := p.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("1"), Val: []byte("hello world"), Ack: ackAs("1")},
+			fusion.Msg{Key: []byte("2"), Val: []byte("a bad one"), Ack: ackAs("2")},
+			fusion.Msg{Key: []byte("3"), Val: []byte(""), Ack: ackAs("3")},
+		))
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"hello", "world", "a", "bad", "one"}, words)
+		assert.Equal(t, map[string]error{"1": nil, "2": fusion.Retry, "3": nil}, acks)
+	})
+
+	t.Run("StageError", func(t *testing.T) {
+		var acked error
+		p := &fusion.Pipeline{
+			Stages: []fusion.Stage{
+				{
+					Func: func(ctx context.Context, msg fusion.Msg, emit fusion.Emit) error {
+						emit(msg)
+						return fusion.Fail
+					},
+				},
+			},
+		}
+
+		err := p.Run(context.Background(), msgStream(fusion.Msg{
+			Ack: func(err error) { acked = err },
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, fusion.Fail, acked)
+	})
+
+	t.Run("SinkError", func(t *testing.T) {
+		p := &fusion.Pipeline{
+			Stages: []fusion.Stage{split},
+			Sink: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+				return errors.New("failed")
+			}),
+		}
+
+		// the message is either nAcked by the stage or left unread.
+		var acked []error
+		err := p.Run(context.Background(), msgStream(fusion.Msg{
+			Val: []byte("hello"),
+			Ack: func(err error) { acked = append(acked, err) },
+		}))
+		assert.Error(t, err)
+		assert.Subset(t, []error{fusion.Retry}, acked)
+	})
+
+	t.Run("SinkExitedEarly", func(t *testing.T) {
+		stream := make(chan fusion.Msg, 2)
+		acks := make(chan error, 2)
+		for _, val := range []string{"a", "b"} {
+			stream <- fusion.Msg{Val: []byte(val), Ack: func(err error) { acks <- err }}
+		}
+
+		p := &fusion.Pipeline{
+			Stages: []fusion.Stage{{}, {}},
+			Sink: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+				msg := <-stream
+				msg.Ack(nil)
+				return errors.New("failed")
+			}),
+		}
+
+		// the stream is never closed, stages must exit when the sink does.
+		err := p.Run(context.Background(), stream)
+		assert.EqualError(t, err, "failed")
+		assert.Equal(t, nil, <-acks)
+		select {
+		case err := <-acks:
+			assert.Equal(t, fusion.Retry, err)
+		default:
+			assert.Len(t, stream, 1, "unread message must be left in the stream")
+		}
+	})
+}
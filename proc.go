@@ -2,12 +2,16 @@ package fusion
 
 import (
 	"context"
-	"fmt"
+	"hash/fnv"
 	"sync"
+	"time"
 )
 
 var _ Proc = (*Fn)(nil)
 
+// laneBuffer is the buffer size of each worker lane in ordered mode.
+const laneBuffer = 16
+
 // Proc represents a processor in the stream pipeline.
 type Proc interface {
 	// Run should spawn the worker threads that consume from 'stream' and
@@ -21,8 +25,20 @@ type Proc interface {
 // ProcFn implements Proc using a simple Go function.
 type ProcFn func(ctx context.Context, stream <-chan Msg) error
 
-// Run dispatches the msg to the wrapped function.
-func (pf ProcFn) Run(ctx context.Context, stream <-chan Msg) error { return pf(ctx, stream) }
+// Run dispatches the msg to the wrapped function. If the function panics, the
+// panic is recovered and returned as PanicError.
+func (pf ProcFn) Run(ctx context.Context, stream <-chan Msg) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			pe := recovered(v)
+			LogFrom(ctx).With(map[string]interface{}{
+				"stack": string(pe.Stack),
+			}).Errorf("recovered from panic in proc: %v", pe.Value)
+			err = pe
+		}
+	}()
+	return pf(ctx, stream)
+}
 
 // Fn implements a concurrent Proc using a custom processor function.
 type Fn struct {
@@ -33,6 +49,50 @@ type Fn struct {
 	// Func is the function to invoke for each message. If not set,
 	// uses a no-op func.
 	Func func(ctx context.Context, msg Msg) error
+
+	// DeadLetter can be set to route messages for which Func returned
+	// Fail to a dead letter sink. If saving to the dead letter fails, the
+	// message is nAcked with Retry instead.
+	DeadLetter DeadLetter
+
+	// Ordered enables per-key ordering. Messages are distributed to the
+	// workers by hash of Msg.Key so that messages with the same key are
+	// always processed by the same worker in the order they were received.
+	// If Func returns Retry (or any unknown error) in this mode, message is
+	// retried in-place after RetryDelay and the worker (along with all the
+	// keys mapped to it) is blocked until it succeeds, fails or the ctx is
+	// cancelled.
+	Ordered bool
+
+	// RetryDelay is the delay between in-place retries in Ordered mode.
+	// Defaults to 1s.
+	RetryDelay time.Duration
+
+	// PanicAck is the error used to acknowledge a message for which Func
+	// panicked. Panics are recovered and logged along with the stack trace.
+	// Defaults to Retry.
+	PanicAck error
+
+	// MaxPanics can be set to trip a circuit when Func panics more than
+	// MaxPanics times within a minute. Once tripped, workers stop, messages
+	// not yet processed are nAcked with Retry and Run returns
+	// ErrTooManyPanics. If not set, the circuit never trips.
+	MaxPanics int
+
+	// Timeout can be set to limit the time Func is given for a message.
+	// Func receives a ctx with the deadline set and the message is acked
+	// with TimeoutAck if it does not return in time. State writes of the
+	// timed-out call are discarded. Func is not waited for beyond the
+	// timeout, so it must honour ctx to avoid leaking goroutines, except in
+	// Ordered mode where the worker waits for Func to return before retrying
+	// or moving on so that the calls for a key never overlap.
+	Timeout time.Duration
+
+	// TimeoutAck is the error used to acknowledge a message that timed out.
+	// Defaults to Retry.
+	TimeoutAck error
+
+	circuit *panicCircuit
 }
 
 // Run spawns the configured number of worker threads.
@@ -40,31 +100,207 @@ func (fn *Fn) Run(ctx context.Context, stream <-chan Msg) error {
 	log := LogFrom(ctx)
 	fn.init()
 
+	lanes := make([]<-chan Msg, fn.Workers)
+	if fn.Ordered {
+		lanes = fn.partition(stream)
+	} else {
+		for i := range lanes {
+			lanes[i] = stream
+		}
+	}
+
 	wg := &sync.WaitGroup{}
 	for i := 0; i < fn.Workers; i++ {
 		wg.Add(1)
 		go func(id int) {
 			defer wg.Done()
-
-			for msg := range stream {
-				err := fn.Func(ctx, msg)
-				msg.Ack(err)
-			}
-			log(map[string]interface{}{
-				"level":   "info",
-				"message": fmt.Sprintf("stream closed, worker %d exiting", id),
-			})
+			fn.work(WithLogFields(ctx, map[string]interface{}{"worker": id}), id, lanes[id])
 		}(i)
 	}
 	wg.Wait()
 
-	log(map[string]interface{}{
-		"level":   "info",
-		"message": "all workers exited",
-	})
+	log.Infof("all workers exited")
+	if fn.circuit.isOpen() {
+		return ErrTooManyPanics
+	}
 	return nil
 }
 
+// work processes the messages from the lane until it is closed or the panic
+// circuit trips.
+func (fn *Fn) work(ctx context.Context, id int, lane <-chan Msg) {
+	log := LogFrom(ctx)
+
+	stop := fn.circuit.tripped
+	if fn.Ordered {
+		// lanes are closed by partition once the circuit trips. so keep
+		// draining until then.
+		stop = nil
+	}
+
+	for {
+		select {
+		case <-stop:
+			log.Warnf("panic circuit open, worker %d exiting", id)
+			return
+
+		case msg, open := <-lane:
+			if !open {
+				log.Infof("stream closed, worker %d exiting", id)
+				return
+			}
+
+			if fn.circuit.isOpen() {
+				msg.Ack(Retry)
+				continue
+			}
+			fn.process(ctx, msg)
+		}
+	}
+}
+
+func (fn *Fn) process(ctx context.Context, msg Msg) {
+	receivedAt := time.Now()
+	ctx, span := startSpan(ctx, "fusion.fn", msg)
+	ctx = WithLogFields(ctx, msgLogFields(msg))
+	ctx = BindState(ctx, &msg)
+
+	err := fn.invoke(ctx, msg)
+	for fn.Ordered && isRetryable(err) && ctx.Err() == nil && !fn.circuit.isOpen() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(fn.RetryDelay):
+			err = fn.invoke(renewState(ctx), msg)
+		}
+	}
+
+	if err == Fail && fn.DeadLetter != nil {
+		if dlErr := putDead(ctx, fn.DeadLetter, msg, err, 1, receivedAt); dlErr != nil {
+			LogFrom(ctx).Warnf("failed to write to dead letter, will retry: %v", dlErr)
+			err = Retry
+		}
+	}
+
+	if span != nil {
+		span.End(err)
+	}
+	msg.Ack(err)
+}
+
+// invoke calls Func with the message within the Timeout (if set) and records
+// the outcome.
+func (fn *Fn) invoke(ctx context.Context, msg Msg) (err error) {
+	metrics := MetricsFrom(ctx)
+
+	start := time.Now()
+	defer func() {
+		tags := map[string]string{"result": ResultLabel(err)}
+		metrics.Count("fusion_fn_results_total", 1, tags)
+		metrics.Observe("fusion_fn_duration_seconds", time.Since(start).Seconds(), tags)
+	}()
+
+	if fn.Timeout <= 0 {
+		return fn.call(ctx, msg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fn.Timeout)
+	defer cancel()
+
+	timer := time.NewTimer(fn.Timeout)
+	defer timer.Stop()
+
+	res := make(chan error, 1)
+	go func() { res <- fn.call(ctx, msg) }()
+
+	select {
+	case err := <-res:
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return fn.onTimeout(ctx, start)
+		}
+		return err
+
+	case <-timer.C:
+		err := fn.onTimeout(ctx, start)
+		if fn.Ordered {
+			<-res
+		}
+		return err
+	}
+}
+
+// call invokes Func. If Func panics, the panic is recovered and PanicAck is
+// returned.
+func (fn *Fn) call(ctx context.Context, msg Msg) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fn.onPanic(ctx, recovered(v))
+		}
+	}()
+	return fn.Func(ctx, msg)
+}
+
+func (fn *Fn) onTimeout(ctx context.Context, start time.Time) error {
+	renewState(ctx) // discard the writes of the timed-out call.
+	LogFrom(ctx).Warnf("func timed out after %s, acking with '%v'", time.Since(start), fn.TimeoutAck)
+	MetricsFrom(ctx).Count("fusion_fn_timeouts_total", 1, nil)
+	return fn.TimeoutAck
+}
+
+func (fn *Fn) onPanic(ctx context.Context, pe PanicError) error {
+	log := LogFrom(ctx)
+	log.With(map[string]interface{}{
+		"stack": string(pe.Stack),
+	}).Errorf("recovered from panic in func: %v", pe.Value)
+	MetricsFrom(ctx).Count("fusion_fn_panics_total", 1, nil)
+
+	if fn.circuit.record(time.Now()) {
+		log.Errorf("more than %d panics in a minute, tripping circuit", fn.MaxPanics)
+	}
+	return fn.PanicAck
+}
+
+// partition distributes the messages from the stream to one lane per worker
+// based on the hash of the message key.
+func (fn *Fn) partition(stream <-chan Msg) []<-chan Msg {
+	lanes := make([]chan Msg, fn.Workers)
+	out := make([]<-chan Msg, fn.Workers)
+	for i := range lanes {
+		lanes[i] = make(chan Msg, laneBuffer)
+		out[i] = lanes[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, lane := range lanes {
+				close(lane)
+			}
+		}()
+
+		for {
+			var msg Msg
+			select {
+			case <-fn.circuit.tripped:
+				return
+			case m, open := <-stream:
+				if !open {
+					return
+				}
+				msg = m
+			}
+
+			h := fnv.New32a()
+			_, _ = h.Write(msg.Key)
+			select {
+			case <-fn.circuit.tripped:
+				msg.Ack(Retry)
+				return
+			case lanes[h.Sum32()%uint32(len(lanes))] <- msg:
+			}
+		}
+	}()
+	return out
+}
+
 func (fn *Fn) init() {
 	if fn.Func == nil {
 		fn.Func = func(_ context.Context, _ Msg) error {
@@ -74,4 +310,34 @@ func (fn *Fn) init() {
 	if fn.Workers == 0 {
 		fn.Workers = 1
 	}
+	if fn.RetryDelay == 0 {
+		fn.RetryDelay = 1 * time.Second
+	}
+	if fn.PanicAck == nil {
+		fn.PanicAck = Retry
+	}
+	if fn.TimeoutAck == nil {
+		fn.TimeoutAck = Retry
+	}
+	fn.circuit = newPanicCircuit(fn.MaxPanics)
+}
+
+// isRetryable returns true if the ack error signals that the message should
+// be retried.
+func isRetryable(err error) bool {
+	return err != nil && err != Skip && err != Fail
+}
+
+// msgLogFields returns the contextual log fields identifying the message.
+func msgLogFields(msg Msg) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if len(msg.Key) > 0 {
+		fields["msg_key"] = string(msg.Key)
+	}
+	for _, attrib := range []string{"topic", "partition", "offset"} {
+		if v, found := msg.Attribs[attrib]; found {
+			fields[attrib] = v
+		}
+	}
+	return fields
 }
@@ -2,9 +2,13 @@ package fusion_test
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/spy16/fusion"
 )
@@ -57,3 +61,220 @@ func TestFn_Run(t *testing.T) {
 		assert.True(t, acked)
 	})
 }
+
+func TestFn_Run_Ordered(t *testing.T) {
+	mu := sync.Mutex{}
+	seen := map[string][]string{}
+	retried := false
+
+	var messages []fusion.Msg
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i%3)
+		messages = append(messages, fusion.Msg{
+			Key: []byte(key),
+			Val: []byte(fmt.Sprintf("%d", i)),
+			Ack: func(err error) { assert.NoError(t, err) },
+		})
+	}
+
+	fn := fusion.Fn{
+		Workers:    4,
+		Ordered:    true,
+		RetryDelay: 1 * time.Millisecond,
+		Func: func(ctx context.Context, msg fusion.Msg) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if string(msg.Val) == "4" && !retried {
+				retried = true
+				return fusion.Retry
+			}
+			seen[string(msg.Key)] = append(seen[string(msg.Key)], string(msg.Val))
+			return nil
+		},
+	}
+
+	err := fn.Run(context.Background(), msgStream(messages...))
+	assert.NoError(t, err)
+	assert.True(t, retried)
+	assert.Equal(t, []string{"0", "3", "6", "9", "12", "15", "18"}, seen["key-0"])
+	assert.Equal(t, []string{"1", "4", "7", "10", "13", "16", "19"}, seen["key-1"])
+	assert.Equal(t, []string{"2", "5", "8", "11", "14", "17"}, seen["key-2"])
+}
+
+func TestFn_Run_Panic(t *testing.T) {
+	t.Run("Recovered", func(t *testing.T) {
+		mu := sync.Mutex{}
+		var acks []error
+		ack := func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			acks = append(acks, err)
+		}
+
+		fn := fusion.Fn{
+			PanicAck: fusion.Fail,
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				if string(msg.Val) == "boom" {
+					panic("boom")
+				}
+				return nil
+			},
+		}
+
+		err := fn.Run(context.Background(), msgStream(
+			fusion.Msg{Val: []byte("boom"), Ack: ack},
+			fusion.Msg{Val: []byte("ok"), Ack: ack},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []error{fusion.Fail, nil}, acks)
+	})
+
+	t.Run("CircuitTripped", func(t *testing.T) {
+		for _, ordered := range []bool{false, true} {
+			mu := sync.Mutex{}
+			acks := map[error]int{}
+			// stream is left open to ensure workers exit on their own.
+			stream := make(chan fusion.Msg)
+			done := make(chan struct{})
+			go func() {
+				for {
+					msg := fusion.Msg{Ack: func(err error) {
+						mu.Lock()
+						defer mu.Unlock()
+						acks[err]++
+					}}
+					select {
+					case <-done:
+						return
+					case stream <- msg:
+					}
+				}
+			}()
+
+			fn := fusion.Fn{
+				Workers:    2,
+				Ordered:    ordered,
+				MaxPanics:  2,
+				RetryDelay: time.Millisecond,
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					panic("boom")
+				},
+			}
+			assert.Equal(t, fusion.ErrTooManyPanics, fn.Run(context.Background(), stream))
+			close(done)
+
+			mu.Lock()
+			assert.Zero(t, acks[nil])
+			assert.NotZero(t, acks[fusion.Retry])
+			mu.Unlock()
+		}
+	})
+}
+
+func TestProcFn_Run_Panic(t *testing.T) {
+	pf := fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+		panic("boom")
+	})
+
+	err := pf.Run(context.Background(), nil)
+	pe, ok := err.(fusion.PanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "boom", pe.Value)
+	assert.Contains(t, string(pe.Stack), "TestProcFn_Run_Panic")
+}
+
+func TestFn_Run_Timeout(t *testing.T) {
+	mu := sync.Mutex{}
+	acks := map[string]error{}
+	ackAs := func(val string) func(err error) {
+		return func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			acks[val] = err
+		}
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+
+	fn := fusion.Fn{
+		Workers: 1,
+		Timeout: 50 * time.Millisecond,
+		Func: func(ctx context.Context, msg fusion.Msg) error {
+			switch string(msg.Val) {
+			case "hung":
+				<-release // ignores ctx.
+			case "honours-ctx":
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	}
+
+	err := fn.Run(context.Background(), msgStream(
+		fusion.Msg{Val: []byte("hung"), Ack: ackAs("hung")},
+		fusion.Msg{Val: []byte("honours-ctx"), Ack: ackAs("honours-ctx")},
+		fusion.Msg{Val: []byte("ok"), Ack: ackAs("ok")},
+	))
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]error{
+		"hung":        fusion.Retry,
+		"honours-ctx": fusion.Retry,
+		"ok":          nil,
+	}, acks)
+}
+
+func TestFn_Run_OrderedTimeout(t *testing.T) {
+	store := &fusion.MemState{}
+
+	mu := sync.Mutex{}
+	running, overlaps := 0, 0
+	var calls []string
+
+	runner := fusion.Runner{
+		State: store,
+		Stream: sliceStream([]fusion.Msg{
+			{Key: []byte("k"), Val: []byte("1"), Ack: func(_ error) {}},
+			{Key: []byte("k"), Val: []byte("2"), Ack: func(_ error) {}},
+		}),
+		Proc: &fusion.Fn{
+			Workers:    2,
+			Ordered:    true,
+			RetryDelay: time.Millisecond,
+			Timeout:    20 * time.Millisecond,
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				mu.Lock()
+				running++
+				if running > 1 {
+					overlaps++
+				}
+				calls = append(calls, string(msg.Val))
+				attempt := len(calls)
+				mu.Unlock()
+
+				defer func() {
+					mu.Lock()
+					running--
+					mu.Unlock()
+				}()
+
+				if attempt == 1 {
+					// ignores ctx and writes after the timeout.
+					time.Sleep(60 * time.Millisecond)
+					return fusion.StateFrom(ctx).Put("stale", []byte("1"))
+				}
+				return fusion.StateFrom(ctx).Put("v", msg.Val)
+			},
+		},
+	}
+	require.NoError(t, runner.Run(context.Background()))
+
+	assert.Equal(t, 0, overlaps)
+	assert.Equal(t, []string{"1", "1", "2"}, calls)
+	assert.Equal(t, map[string]string{"v": "2"}, rangeAll(t, store, ""))
+}
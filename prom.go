@@ -0,0 +1,190 @@
+package fusion
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var _ Metrics = (*PromMetrics)(nil)
+
+// DefBuckets are the default histogram buckets used by PromMetrics. These
+// are tailored to measure processing durations in seconds.
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PromMetrics implements Metrics by aggregating all the values in-memory and
+// exposes them in the Prometheus text exposition format. PromMetrics can be
+// mounted directly as an HTTP handler (e.g., at /metrics).
+type PromMetrics struct {
+	// Buckets to use for all histograms. If not set, DefBuckets will be
+	// used.
+	Buckets []float64
+
+	mu       sync.Mutex
+	families map[string]*promFamily
+}
+
+type promFamily struct {
+	kind   string
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	value   float64
+	sum     float64
+	count   uint64
+	buckets []uint64
+}
+
+// Count adds delta to the counter.
+func (pm *PromMetrics) Count(name string, delta float64, tags map[string]string) {
+	pm.update("counter", name, tags, func(s *promSeries) { s.value += delta })
+}
+
+// Gauge sets the value of the gauge.
+func (pm *PromMetrics) Gauge(name string, value float64, tags map[string]string) {
+	pm.update("gauge", name, tags, func(s *promSeries) { s.value = value })
+}
+
+// Observe records the value in the histogram.
+func (pm *PromMetrics) Observe(name string, value float64, tags map[string]string) {
+	pm.update("histogram", name, tags, func(s *promSeries) {
+		buckets := pm.buckets()
+		if s.buckets == nil {
+			s.buckets = make([]uint64, len(buckets))
+		}
+		for i, upper := range buckets {
+			if value <= upper {
+				s.buckets[i]++
+			}
+		}
+		s.sum += value
+		s.count++
+	})
+}
+
+// ServeHTTP writes all the metrics in the Prometheus text format.
+func (pm *PromMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = pm.Write(w)
+}
+
+// Write writes all the metrics in the Prometheus text format to w. Metric
+// families and series are sorted by name and labels respectively.
+func (pm *PromMetrics) Write(w io.Writer) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, name := range sortedKeys(pm.families) {
+		fam := pm.families[name]
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, fam.kind)
+
+		for _, labels := range sortedKeys(fam.series) {
+			s := fam.series[labels]
+			if fam.kind != "histogram" {
+				fmt.Fprintf(bw, "%s%s %s\n", name, wrapLabels(labels), formatFloat(s.value))
+				continue
+			}
+
+			for i, upper := range pm.buckets() {
+				le := fmt.Sprintf(`le="%s"`, formatFloat(upper))
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(labels, le)), s.buckets[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, wrapLabels(labels), formatFloat(s.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", name, wrapLabels(labels), s.count)
+		}
+	}
+	return bw.Flush()
+}
+
+func (pm *PromMetrics) update(kind, name string, tags map[string]string, fn func(s *promSeries)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.families == nil {
+		pm.families = map[string]*promFamily{}
+	}
+
+	fam, found := pm.families[name]
+	if !found {
+		fam = &promFamily{kind: kind, series: map[string]*promSeries{}}
+		pm.families[name] = fam
+	} else if fam.kind != kind {
+		return // same name used with different kinds. ignore.
+	}
+
+	labels := formatLabels(tags)
+	s, found := fam.series[labels]
+	if !found {
+		s = &promSeries{}
+		fam.series[labels] = s
+	}
+	fn(s)
+}
+
+func (pm *PromMetrics) buckets() []float64 {
+	if len(pm.Buckets) == 0 {
+		return DefBuckets
+	}
+	return pm.Buckets
+}
+
+func formatLabels(tags map[string]string) string {
+	var pairs []string
+	for _, k := range sortedKeys(tags) {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(tags[k])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	} else if math.IsInf(f, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string]string:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*promFamily:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*promSeries:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
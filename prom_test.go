@@ -0,0 +1,76 @@
+package fusion_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestPromMetrics(t *testing.T) {
+	pm := &fusion.PromMetrics{Buckets: []float64{0.1, 1}}
+	pm.Count("requests_total", 1, map[string]string{"code": "200"})
+	pm.Count("requests_total", 2, map[string]string{"code": "200"})
+	pm.Count("requests_total", 1, map[string]string{"code": `5"0"0`})
+	pm.Gauge("queue_size", 5, nil)
+	pm.Gauge("queue_size", 3, nil)
+	pm.Observe("latency_seconds", 0.05, nil)
+	pm.Observe("latency_seconds", 0.5, nil)
+	pm.Observe("latency_seconds", 5, nil)
+
+	rec := httptest.NewRecorder()
+	pm.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# TYPE queue_size gauge
+queue_size 3
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="5\"0\"0"} 1
+`
+	assert.Equal(t, want, rec.Body.String())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+}
+
+func TestRunner_Run_Metrics(t *testing.T) {
+	pm := &fusion.PromMetrics{}
+	fu := fusion.Runner{
+		Metrics: pm,
+		Stream:  &fusion.LineStream{From: strings.NewReader("ok\nskip\nfail\n")},
+		Proc: &fusion.Fn{
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				switch strings.TrimSpace(string(msg.Val)) {
+				case "skip":
+					return fusion.Skip
+				case "fail":
+					return fusion.Fail
+				}
+				return nil
+			},
+		},
+	}
+	require.NoError(t, fu.Run(context.Background()))
+
+	out := &strings.Builder{}
+	require.NoError(t, pm.Write(out))
+	for _, line := range []string{
+		`fusion_runner_messages_total 3`,
+		`fusion_runner_acks_total{result="success"} 1`,
+		`fusion_runner_acks_total{result="skip"} 1`,
+		`fusion_runner_acks_total{result="fail"} 1`,
+		`fusion_fn_results_total{result="success"} 1`,
+		`fusion_fn_duration_seconds_count{result="fail"} 1`,
+	} {
+		assert.Contains(t, out.String(), line)
+	}
+}
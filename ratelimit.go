@@ -0,0 +1,270 @@
+package fusion
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+var _ Proc = (*RateLimit)(nil)
+
+// RateLimit implements a Proc that limits the rate at which messages are
+// passed on to the wrapped Proc. Messages are held (not acked) until tokens
+// are available. Messages still held when ctx is cancelled are nAcked with
+// Retry.
+type RateLimit struct {
+	// Proc to pass the messages on to.
+	Proc Proc
+
+	// Rate is the number of messages per second allowed across all keys
+	// with bursts of up to Burst messages. If Rate is not set, there is no
+	// global limit. Burst defaults to 1.
+	Rate  float64
+	Burst int
+
+	// KeyRate and KeyBurst can be set to additionally limit the messages
+	// of each key returned by KeyFunc. KeyBurst defaults to 1.
+	KeyRate  float64
+	KeyBurst int
+
+	// KeyFunc returns the key used for per-key limits. Defaults to Msg.Key.
+	// AttribKey can be used for limiting by a message attribute.
+	KeyFunc func(msg Msg) string
+
+	// Workers is the number of goroutines waiting on the per-key limits.
+	// Messages are distributed by hash of the key so that a throttled key
+	// holds up only the keys sharing its worker. Defaults to 8 if KeyRate
+	// is set and to 1 otherwise.
+	Workers int
+
+	global *tokenBucket
+}
+
+// AttribKey returns a KeyFunc that uses the value of the given attribute as
+// the key for per-key limits.
+func AttribKey(name string) func(msg Msg) string {
+	return func(msg Msg) string { return msg.Attribs[name] }
+}
+
+// Run starts the wrapped Proc with a stream of rate limited messages and
+// blocks until it exits. Returns the error returned by the wrapped Proc.
+func (rl *RateLimit) Run(ctx context.Context, stream <-chan Msg) error {
+	if err := rl.init(); err != nil {
+		return err
+	}
+
+	return Feed(ctx, rl.Proc, func(ctx context.Context, out chan<- Msg) {
+		lanes := []<-chan Msg{stream}
+		if rl.KeyRate > 0 {
+			lanes = rl.partition(ctx, stream)
+		}
+
+		wg := &sync.WaitGroup{}
+		for _, lane := range lanes {
+			wg.Add(1)
+			go func(lane <-chan Msg) {
+				defer wg.Done()
+				rl.forward(ctx, lane, out)
+			}(lane)
+		}
+		wg.Wait()
+	})
+}
+
+// forward passes messages from the lane to out as the limits allow.
+func (rl *RateLimit) forward(ctx context.Context, lane <-chan Msg, out chan<- Msg) {
+	metrics := MetricsFrom(ctx)
+	keys := map[string]*tokenBucket{}
+	lastSweep := time.Now()
+
+	for {
+		var msg Msg
+		select {
+		case <-ctx.Done():
+			return
+		case m, open := <-lane:
+			if !open {
+				return
+			}
+			msg = m
+		}
+
+		start := time.Now()
+		var buckets []*tokenBucket
+		if rl.KeyRate > 0 {
+			key := rl.KeyFunc(msg)
+			if keys[key] == nil {
+				keys[key] = newTokenBucket(rl.KeyRate, rl.KeyBurst, start)
+			}
+			buckets = append(buckets, keys[key])
+		}
+		if rl.global != nil {
+			buckets = append(buckets, rl.global)
+		}
+
+		if !waitTokens(ctx, buckets) {
+			msg.Ack(Retry)
+			return
+		}
+		metrics.Observe("fusion_ratelimit_wait_seconds", time.Since(start).Seconds(), nil)
+
+		select {
+		case <-ctx.Done():
+			msg.Ack(Retry)
+			return
+		case out <- msg:
+		}
+
+		// buckets that have refilled completely are same as new ones.
+		if now := time.Now(); now.Sub(lastSweep) > time.Minute {
+			for key, tb := range keys {
+				if tb.isFull(now) {
+					delete(keys, key)
+				}
+			}
+			lastSweep = now
+		}
+	}
+}
+
+// partition distributes the messages from the stream to the lanes based on
+// the hash of the key.
+func (rl *RateLimit) partition(ctx context.Context, stream <-chan Msg) []<-chan Msg {
+	lanes := make([]chan Msg, rl.Workers)
+	out := make([]<-chan Msg, rl.Workers)
+	for i := range lanes {
+		lanes[i] = make(chan Msg)
+		out[i] = lanes[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, lane := range lanes {
+				close(lane)
+			}
+		}()
+
+		for msg := range stream {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(rl.KeyFunc(msg)))
+			select {
+			case <-ctx.Done():
+				msg.Ack(Retry)
+				return
+			case lanes[h.Sum32()%uint32(len(lanes))] <- msg:
+			}
+		}
+	}()
+	return out
+}
+
+func (rl *RateLimit) init() error {
+	if rl.Proc == nil {
+		return errors.New("proc must not be nil")
+	}
+	if rl.Burst <= 0 {
+		rl.Burst = 1
+	}
+	if rl.KeyBurst <= 0 {
+		rl.KeyBurst = 1
+	}
+	if rl.KeyFunc == nil {
+		rl.KeyFunc = func(msg Msg) string { return string(msg.Key) }
+	}
+	if rl.Workers <= 0 {
+		rl.Workers = 1
+		if rl.KeyRate > 0 {
+			rl.Workers = 8
+		}
+	}
+	if rl.Rate > 0 {
+		rl.global = newTokenBucket(rl.Rate, rl.Burst, time.Now())
+	}
+	return nil
+}
+
+// waitTokens takes a token from each of the buckets and waits until all of
+// them are available. Returns false if ctx is cancelled while waiting, in
+// which case the tokens are returned to the buckets.
+func waitTokens(ctx context.Context, buckets []*tokenBucket) bool {
+	now := time.Now()
+	var delay time.Duration
+	for _, tb := range buckets {
+		if d := tb.reserve(now); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		for _, tb := range buckets {
+			tb.cancel()
+		}
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// tokenBucket implements the token bucket algorithm. Tokens are allowed to
+// go negative to account for the reservations that are being waited on.
+type tokenBucket struct {
+	rate  float64 // tokens per second.
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// reserve takes a token and returns the time to wait before it is usable.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(now)
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// cancel returns a reserved token.
+func (tb *tokenBucket) cancel() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.tokens = math.Min(tb.burst, tb.tokens+1)
+}
+
+func (tb *tokenBucket) isFull(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens = math.Min(tb.burst, tb.tokens+elapsed.Seconds()*tb.rate)
+		tb.last = now
+	}
+}
@@ -0,0 +1,86 @@
+package fusion_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/fusion"
+)
+
+func TestRateLimit_Run(t *testing.T) {
+	t.Parallel()
+
+	forward := &fusion.Fn{
+		Func: func(ctx context.Context, msg fusion.Msg) error { return nil },
+	}
+
+	t.Run("NoProc", func(t *testing.T) {
+		rl := &fusion.RateLimit{}
+		assert.Error(t, rl.Run(context.Background(), msgStream()))
+	})
+
+	t.Run("Global", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		rl := &fusion.RateLimit{Proc: forward, Rate: 50, Burst: 2}
+
+		start := time.Now()
+		err := rl.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("a"), Ack: ackAs("1")},
+			fusion.Msg{Key: []byte("b"), Ack: ackAs("2")},
+			fusion.Msg{Key: []byte("c"), Ack: ackAs("3")},
+			fusion.Msg{Key: []byte("d"), Ack: ackAs("4")},
+			fusion.Msg{Key: []byte("e"), Ack: ackAs("5")},
+			fusion.Msg{Key: []byte("f"), Ack: ackAs("6")},
+		))
+		assert.NoError(t, err)
+
+		// 2 messages in the burst and then one every 20ms.
+		assert.True(t, time.Since(start) >= 80*time.Millisecond)
+		assert.Len(t, acks(), 6)
+		for _, err := range acks() {
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("PerAttrib", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		rl := &fusion.RateLimit{
+			Proc:    forward,
+			KeyRate: 20,
+			KeyFunc: fusion.AttribKey("tenant"),
+		}
+
+		tenant := func(name string) map[string]string { return map[string]string{"tenant": name} }
+
+		start := time.Now()
+		err := rl.Run(context.Background(), msgStream(
+			fusion.Msg{Attribs: tenant("t1"), Ack: ackAs("1")},
+			fusion.Msg{Attribs: tenant("t1"), Ack: ackAs("2")},
+			fusion.Msg{Attribs: tenant("t1"), Ack: ackAs("3")},
+			fusion.Msg{Attribs: tenant("t2"), Ack: ackAs("4")},
+		))
+		assert.NoError(t, err)
+
+		// t1 needs 2 intervals of 50ms.
+		assert.True(t, time.Since(start) >= 100*time.Millisecond)
+		assert.Len(t, acks(), 4)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		rl := &fusion.RateLimit{Proc: forward, Rate: 0.01}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := rl.Run(ctx, msgStream(
+			fusion.Msg{Ack: ackAs("1")},
+			fusion.Msg{Ack: ackAs("2")},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]error{"1": nil, "2": fusion.Retry}, acks())
+	})
+}
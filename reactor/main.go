@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,6 +14,7 @@ import (
 	"github.com/spy16/fusion"
 
 	"github.com/spy16/fusion/reactor/stream"
+	"github.com/spy16/fusion/retry"
 )
 
 func main() {
@@ -20,6 +22,7 @@ func main() {
 	go callOnInterrupt(cancel)
 
 	config := flag.String("config", "reactor.json", "Configuration file")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on (e.g., :9100)")
 	flag.Parse()
 	if *config == "" {
 		fatalExit("-config must be specified")
@@ -27,10 +30,20 @@ func main() {
 
 	cfg := readConf(*config)
 
+	metrics := &fusion.PromMetrics{}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr, metrics)
+	}
+
 	fu := fusion.Runner{
-		Stream:    cfg.Kafka,
-		DrainTime: 5 * time.Second,
-		Log:       jsonLog,
+		Stream:          &cfg.Kafka,
+		DrainTime:       5 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+		Supervise: &fusion.Supervisor{
+			Backoff: retry.ExpBackoff(2, 1*time.Second, 30*time.Second),
+		},
+		Log:     jsonLog,
+		Metrics: metrics,
 		Proc: &fusion.Fn{
 			Workers: 10,
 			Func: func(ctx context.Context, msg fusion.Msg) error {
@@ -41,10 +54,7 @@ func main() {
 
 				protoMsg, err := cfg.Proto.Unmarshal(msg.Val)
 				if err != nil {
-					jsonLog(map[string]interface{}{
-						"level":   "error",
-						"message": err.Error(),
-					})
+					jsonLog.Errorf("%v", err)
 					return err
 				}
 				_ = json.NewEncoder(os.Stdout).Encode(protoMsg)
@@ -57,13 +67,10 @@ func main() {
 		fatalExit("fusion runner exited with error: %v", err)
 	}
 
-	jsonLog(map[string]interface{}{
-		"level":   "info",
-		"message": "fusion runner exited successfully",
-	})
+	jsonLog.Infof("fusion runner exited successfully")
 }
 
-func readConf(configFile string) Config {
+func readConf(configFile string) *Config {
 	f, err := os.Open(configFile)
 	if err != nil {
 		fatalExit("failed to open config file: %v", err)
@@ -74,7 +81,7 @@ func readConf(configFile string) Config {
 	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
 		fatalExit("failed to read configs from '%s': %v", configFile, err)
 	}
-	return cfg
+	return &cfg
 }
 
 type Config struct {
@@ -91,13 +98,21 @@ func fatalExit(msg string, args ...interface{}) {
 	os.Exit(1)
 }
 
+func serveMetrics(addr string, metrics http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fatalExit("failed to serve metrics: %v", err)
+	}
+}
+
 func callOnInterrupt(cancel context.CancelFunc) {
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	<-sigCh
 	cancel()
 }
 
-func jsonLog(fields map[string]interface{}) {
+var jsonLog fusion.Log = func(fields map[string]interface{}) {
 	_ = json.NewEncoder(os.Stderr).Encode(fields)
 }
@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/spy16/fusion"
+)
+
+var _ fusion.DeadLetter = (*KafkaDeadLetter)(nil)
+
+// KafkaDeadLetter implements fusion.DeadLetter by writing the dead messages
+// as JSON to a Kafka topic. Key of the original message is retained and the
+// failure details are also set as headers so that the topic can be replayed
+// using the Kafka stream.
+type KafkaDeadLetter struct {
+	Topic   string   `json:"topic"`
+	Brokers []string `json:"brokers"`
+
+	once   sync.Once
+	writer *kafka.Writer
+}
+
+// Put writes the dead message to the configured topic and blocks until the
+// write is acknowledged by the brokers.
+func (kdl *KafkaDeadLetter) Put(ctx context.Context, dm fusion.DeadMsg) error {
+	if kdl.Topic == "" || len(kdl.Brokers) == 0 {
+		return errors.New("topic and brokers must be set")
+	}
+
+	kdl.once.Do(func() {
+		kdl.writer = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:      kdl.Brokers,
+			Topic:        kdl.Topic,
+			RequiredAcks: -1,
+		})
+	})
+
+	val, err := json.Marshal(dm)
+	if err != nil {
+		return err
+	}
+
+	return kdl.writer.WriteMessages(ctx, kafka.Message{
+		Key:   dm.Msg.Key,
+		Value: val,
+		Headers: []kafka.Header{
+			{Key: "error", Value: []byte(dm.Error)},
+			{Key: "attempts", Value: []byte(strconv.Itoa(dm.Attempts))},
+		},
+	})
+}
+
+// Close flushes pending writes and closes the underlying Kafka writer.
+func (kdl *KafkaDeadLetter) Close() error {
+	if kdl.writer == nil {
+		return nil
+	}
+	return kdl.writer.Close()
+}
@@ -2,18 +2,35 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/retry"
 )
 
+var (
+	_ fusion.Stream  = (*Kafka)(nil)
+	_ fusion.Flusher = (*Kafka)(nil)
+)
+
+// errInterrupted is returned by next when the fetch was interrupted since a
+// message got nAcked or a redelivery became due.
+var errInterrupted = errors.New("fetch interrupted for redelivery")
+
 // Kafka implements fusion stream using the Kafka system as the backend with
 // support for consumer groups. This implementation uses manual commit based
-// on the Ack function to ensure at-least once delivery. Downstream consumers
-// must take care of idempotency.
+// on the Ack function to ensure at-least once delivery. Offsets are tracked
+// per partition and committed periodically only up to the highest offset for
+// which all the previous messages have been acked. Messages acked with Retry
+// (or any unknown error) are redelivered in-process, while Fail and Skip are
+// considered done and are committed. Offsets of messages acked after the
+// stream is stopped are committed by Flush. Downstream consumers must take
+// care of idempotency (e.g., using fusion.Dedupe).
 type Kafka struct {
 	Workers  int           `json:"workers"`
 	Topic    string        `json:"topic"`
@@ -23,14 +40,53 @@ type Kafka struct {
 	MaxBytes int           `json:"max_bytes"`
 	MaxWait  time.Duration `json:"max_wait"`
 
-	log fusion.Log
+	// CommitInterval is the interval at which acked offsets are committed.
+	// Defaults to 1s.
+	CommitInterval time.Duration `json:"commit_interval"`
+
+	// StatsInterval is the interval at which reader stats are reported
+	// to the metrics set on the Runner. Defaults to 10s.
+	StatsInterval time.Duration `json:"stats_interval"`
+
+	// RedeliveryBuffer is the number of nAcked messages held for redelivery
+	// beyond which no new messages are fetched until some of them are
+	// redelivered. nAcked messages are never dropped, so the buffer may
+	// exceed this by the number of messages in-flight. Defaults to 100.
+	RedeliveryBuffer int `json:"redelivery_buffer"`
+
+	// Backoff can be set to delay the redelivery of nAcked messages based
+	// on the number of attempts. If not set, messages are redelivered as
+	// soon as possible.
+	Backoff retry.Backoff `json:"-"`
+
+	log      fusion.Log
+	hotLog   fusion.Log // sampled log for per-message failures.
+	metrics  fusion.Metrics
+	fetchSem chan struct{}
+	offsets  *offsetTracker
+	reader   *kafka.Reader
+	commitMu sync.Mutex
+
+	// buffer for maintaining messages that got nAcked. wake is closed and
+	// replaced every time a message is added to it.
+	mu     sync.Mutex
+	nAcked []redelivery
+	wake   chan struct{}
+}
+
+type redelivery struct {
+	msg      kafka.Message
+	attempts int
+	at       time.Time
 }
 
 // Out validates the Kafka config, creates a kafka consumer connection to the
 // cluster and returns a fusion message channel where it streams the messages
 // from Kafka.
-func (ks Kafka) Out(ctx context.Context) (<-chan fusion.Msg, error) {
+func (ks *Kafka) Out(ctx context.Context) (<-chan fusion.Msg, error) {
 	ks.log = fusion.LogFrom(ctx)
+	ks.hotLog = ks.log.Sample(100)
+	ks.metrics = fusion.MetricsFrom(ctx)
 	conf := kafka.ReaderConfig{
 		Brokers:  ks.Brokers,
 		Topic:    ks.Topic,
@@ -43,15 +99,30 @@ func (ks Kafka) Out(ctx context.Context) (<-chan fusion.Msg, error) {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
+	if ks.CommitInterval <= 0 {
+		ks.CommitInterval = 1 * time.Second
+	}
+	if ks.StatsInterval <= 0 {
+		ks.StatsInterval = 10 * time.Second
+	}
+	if ks.RedeliveryBuffer <= 0 {
+		ks.RedeliveryBuffer = 100
+	}
+	ks.offsets = newOffsetTracker()
+	ks.fetchSem = make(chan struct{}, 1)
+	ks.wake = make(chan struct{})
+
 	out := make(chan fusion.Msg)
 	kafkaReader := kafka.NewReader(conf)
+	ks.reader = kafkaReader
 	stats := kafkaReader.Stats()
 
-	ks.log(map[string]interface{}{
-		"level":       "info",
-		"message":     fmt.Sprintf("reader initialised to '%s'", stats.Topic),
+	ks.log.With(map[string]interface{}{
 		"current_lag": kafkaReader.Lag(),
-	})
+	}).Infof("reader initialised to '%s'", stats.Topic)
+
+	go ks.commitLoop(ctx, kafkaReader)
+	go ks.statsLoop(ctx, kafkaReader)
 
 	go func() {
 		defer close(out)
@@ -62,47 +133,43 @@ func (ks Kafka) Out(ctx context.Context) (<-chan fusion.Msg, error) {
 			go func(id int) {
 				defer wg.Done()
 				ks.streamKafka(ctx, kafkaReader, out)
-				ks.log(map[string]interface{}{
-					"level":   "info",
-					"message": fmt.Sprintf("worker %d exited", id),
-				})
+				ks.log.Infof("worker %d exited", id)
 			}(i)
 		}
 		wg.Wait()
-		ks.log(map[string]interface{}{
-			"level":   "info",
-			"message": "all workers exited, closing stream",
-		})
+		ks.log.Infof("all workers exited, closing stream")
 	}()
 
 	return out, nil
 }
 
-func (ks Kafka) streamKafka(ctx context.Context, kr *kafka.Reader, out chan<- fusion.Msg) {
+func (ks *Kafka) streamKafka(ctx context.Context, kr *kafka.Reader, out chan<- fusion.Msg) {
 	for ctx.Err() == nil {
-		msg, err := kr.FetchMessage(ctx)
+		msg, attempts, err := ks.next(ctx, kr)
 		if err != nil {
-			ks.log(map[string]interface{}{
-				"level":   "error",
-				"message": fmt.Sprintf("reading from kafka failed: %v", err),
-			})
+			if err != errInterrupted {
+				ks.hotLog.Errorf("reading from kafka failed: %v", err)
+			}
 			continue
 		}
 
+		// headers (e.g., traceparent set by KafkaSink) are exposed as
+		// attributes along with the origin of the message.
+		attribs := map[string]string{}
+		for _, h := range msg.Headers {
+			attribs[h.Key] = string(h.Value)
+		}
+		attribs["topic"] = msg.Topic
+		attribs["partition"] = strconv.Itoa(msg.Partition)
+		attribs["offset"] = strconv.FormatInt(msg.Offset, 10)
+
+		once := &sync.Once{}
 		fuMsg := fusion.Msg{
 			Key:     msg.Key,
 			Val:     msg.Value,
-			Attribs: map[string]string{"topic": kr.Stats().Topic},
+			Attribs: attribs,
 			Ack: func(err error) {
-				if err != nil {
-					ks.log(map[string]interface{}{
-						"level":   "warn",
-						"message": fmt.Sprintf("got error for message, will not commit: %v", err),
-					})
-					// do not acknowledge. rely on auto-commit false.
-					return
-				}
-				_ = kr.CommitMessages(ctx, msg)
+				once.Do(func() { ks.ack(msg, attempts, err) })
 			},
 		}
 
@@ -114,3 +181,210 @@ func (ks Kafka) streamKafka(ctx context.Context, kr *kafka.Reader, out chan<- fu
 		}
 	}
 }
+
+// next returns the next message to be streamed along with the number of
+// times it has been delivered before. Messages due for redelivery are
+// preferred over fetching new messages and no new messages are fetched while
+// the redelivery buffer is full. Returns errInterrupted if a message got
+// nAcked or a redelivery became due while waiting for a new message.
+func (ks *Kafka) next(ctx context.Context, kr *kafka.Reader) (kafka.Message, int, error) {
+	// wake must be read before popping so that a message nAcked after
+	// popping is not missed.
+	wake, full := ks.watch()
+	rd, wait := ks.popRedelivery()
+	if rd != nil {
+		return rd.msg, rd.attempts, nil
+	}
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if wait > 0 {
+		// do not block beyond the time of next redelivery.
+		var cancelWait context.CancelFunc
+		fetchCtx, cancelWait = context.WithTimeout(fetchCtx, wait)
+		defer cancelWait()
+	}
+
+	go func() {
+		select {
+		case <-wake:
+			cancel()
+		case <-fetchCtx.Done():
+		}
+	}()
+
+	var msg kafka.Message
+	var err error
+	if full {
+		<-fetchCtx.Done()
+		err = fetchCtx.Err()
+	} else {
+		msg, err = ks.fetch(fetchCtx, kr)
+	}
+
+	if err != nil && ctx.Err() == nil && fetchCtx.Err() != nil {
+		return kafka.Message{}, 0, errInterrupted
+	}
+	return msg, 0, err
+}
+
+func (ks *Kafka) ack(msg kafka.Message, attempts int, err error) {
+	ks.metrics.Count("fusion_kafka_acks_total", 1, map[string]string{
+		"topic":  msg.Topic,
+		"result": fusion.ResultLabel(err),
+	})
+
+	if err == nil || err == fusion.Fail || err == fusion.Skip {
+		ks.offsets.ack(msg)
+		return
+	}
+
+	// the message is never committed and the buffer always takes it since
+	// fetching is paused while the buffer is full.
+	ks.redeliver(msg, attempts+1)
+	ks.metrics.Count("fusion_kafka_redeliveries_total", 1, map[string]string{"topic": msg.Topic})
+}
+
+// redeliver adds the message to the redelivery buffer and wakes up the
+// workers waiting for a message.
+func (ks *Kafka) redeliver(msg kafka.Message, attempts int) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	at := time.Now()
+	if ks.Backoff != nil {
+		at = at.Add(ks.Backoff.RetryAfter(attempts))
+	}
+	ks.nAcked = append(ks.nAcked, redelivery{msg: msg, attempts: attempts, at: at})
+
+	close(ks.wake)
+	ks.wake = make(chan struct{})
+}
+
+// watch returns a channel that is closed when a message is nAcked next and
+// whether the redelivery buffer is full.
+func (ks *Kafka) watch() (<-chan struct{}, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.wake, len(ks.nAcked) >= ks.RedeliveryBuffer
+}
+
+// popRedelivery returns the earliest message that is due for redelivery. If
+// no message is due, returns the time to wait until the next one is due (0
+// if there are no nAcked messages).
+func (ks *Kafka) popRedelivery() (*redelivery, time.Duration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if len(ks.nAcked) == 0 {
+		return nil, 0
+	}
+
+	now := time.Now()
+	earliest := 0
+	for i, rd := range ks.nAcked {
+		if rd.at.Before(ks.nAcked[earliest].at) {
+			earliest = i
+		}
+	}
+
+	rd := ks.nAcked[earliest]
+	if wait := rd.at.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	ks.nAcked = append(ks.nAcked[:earliest], ks.nAcked[earliest+1:]...)
+	return &rd, 0
+}
+
+// fetch reads the next message and registers it with the offset tracker.
+// Both are done under a lock so that the messages are tracked in the order
+// they were fetched.
+func (ks *Kafka) fetch(ctx context.Context, kr *kafka.Reader) (kafka.Message, error) {
+	select {
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	case ks.fetchSem <- struct{}{}:
+	}
+	defer func() { <-ks.fetchSem }()
+
+	msg, err := kr.FetchMessage(ctx)
+	if err != nil {
+		return msg, err
+	}
+	ks.offsets.track(msg)
+	return msg, nil
+}
+
+// commitLoop periodically commits the offsets that are safe to commit and
+// does a final commit when the ctx is cancelled.
+func (ks *Kafka) commitLoop(ctx context.Context, kr *kafka.Reader) {
+	ticker := time.NewTicker(ks.CommitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ks.commit(flushCtx, kr)
+			return
+
+		case <-ticker.C:
+			ks.commit(ctx, kr)
+		}
+	}
+}
+
+// Flush commits the offsets of the messages acknowledged since the stream was
+// stopped and closes the reader. Flush must be called only after the ctx
+// passed to Out is cancelled.
+func (ks *Kafka) Flush(ctx context.Context) error {
+	if ks.reader == nil {
+		return nil
+	}
+	ks.commit(ctx, ks.reader)
+	return ks.reader.Close()
+}
+
+func (ks *Kafka) commit(ctx context.Context, kr *kafka.Reader) {
+	// commits must not overlap so that a newer offset is never overwritten
+	// with an older one.
+	ks.commitMu.Lock()
+	defer ks.commitMu.Unlock()
+
+	msgs := ks.offsets.committable()
+	if len(msgs) == 0 {
+		return
+	}
+
+	if err := kr.CommitMessages(ctx, msgs...); err != nil {
+		ks.offsets.restore(msgs)
+		ks.log.Warnf("failed to commit offsets: %v", err)
+	}
+}
+
+// statsLoop periodically reports the reader stats as metrics. Stats of the
+// reader are reset every time they are read, so counters are reported as
+// deltas.
+func (ks *Kafka) statsLoop(ctx context.Context, kr *kafka.Reader) {
+	ticker := time.NewTicker(ks.StatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			st := kr.Stats()
+			tags := map[string]string{"topic": st.Topic}
+			ks.metrics.Count("fusion_kafka_messages_total", float64(st.Messages), tags)
+			ks.metrics.Count("fusion_kafka_bytes_total", float64(st.Bytes), tags)
+			ks.metrics.Count("fusion_kafka_errors_total", float64(st.Errors), tags)
+			ks.metrics.Count("fusion_kafka_timeouts_total", float64(st.Timeouts), tags)
+			ks.metrics.Count("fusion_kafka_rebalances_total", float64(st.Rebalances), tags)
+			ks.metrics.Gauge("fusion_kafka_lag", float64(st.Lag), tags)
+			ks.metrics.Gauge("fusion_kafka_queue_length", float64(st.QueueLength), tags)
+		}
+	}
+}
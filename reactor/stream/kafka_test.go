@@ -0,0 +1,199 @@
+package stream
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/retry"
+)
+
+func TestKafka_redeliver(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Backoff", func(t *testing.T) {
+		ks := newTestKafka(1)
+		ks.Backoff = retry.ConstBackoff(time.Hour)
+
+		ks.redeliver(at(0, 1), 2)
+		rd, wait := ks.popRedelivery()
+		if rd != nil {
+			t.Errorf("popRedelivery() must not return a message before it is due, got %v", rd.msg.Offset)
+		}
+		if wait <= 59*time.Minute || wait > time.Hour {
+			t.Errorf("popRedelivery() wait = %s, want ~1h", wait)
+		}
+	})
+
+	t.Run("NotCommittedWhenFull", func(t *testing.T) {
+		ks := newTestKafka(1)
+		ks.offsets.track(at(0, 1))
+		ks.offsets.track(at(0, 2))
+
+		ks.ack(at(0, 1), 0, fusion.Retry)
+		ks.ack(at(0, 2), 0, fusion.Retry)
+
+		// both are held for redelivery even though the buffer is full, so
+		// nothing is committable.
+		if got := offsetsOf(ks.offsets.committable()); len(got) != 0 {
+			t.Errorf("committable() = %v, want none", got)
+		}
+		if _, full := ks.watch(); !full {
+			t.Errorf("watch() must report the buffer as full")
+		}
+
+		for i := 0; i < 2; i++ {
+			rd, _ := ks.popRedelivery()
+			if rd == nil || rd.attempts != 1 {
+				t.Fatalf("popRedelivery() = %+v, want a message with 1 attempt", rd)
+			}
+			ks.ack(rd.msg, rd.attempts, nil)
+		}
+
+		want := map[int]int64{0: 2}
+		if got := offsetsOf(ks.offsets.committable()); !reflect.DeepEqual(got, want) {
+			t.Errorf("committable() = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestKafka_popRedelivery(t *testing.T) {
+	t.Parallel()
+
+	ks := newTestKafka(10)
+	if rd, wait := ks.popRedelivery(); rd != nil || wait != 0 {
+		t.Fatalf("popRedelivery() = (%v, %s), want (nil, 0)", rd, wait)
+	}
+
+	now := time.Now()
+	ks.nAcked = []redelivery{
+		{msg: at(0, 3), attempts: 1, at: now.Add(-1 * time.Second)},
+		{msg: at(0, 1), attempts: 2, at: now.Add(-3 * time.Second)},
+		{msg: at(0, 4), attempts: 1, at: now.Add(time.Hour)},
+		{msg: at(0, 2), attempts: 1, at: now.Add(-2 * time.Second)},
+	}
+
+	var got []int64
+	for {
+		rd, wait := ks.popRedelivery()
+		if rd == nil {
+			if wait <= 0 {
+				t.Errorf("popRedelivery() wait = %s, want > 0 for the pending message", wait)
+			}
+			break
+		}
+		got = append(got, rd.msg.Offset)
+	}
+
+	want := []int64{1, 2, 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("popRedelivery() order = %v, want %v", got, want)
+	}
+	if len(ks.nAcked) != 1 || ks.nAcked[0].msg.Offset != 4 {
+		t.Errorf("message not due must be retained, got %+v", ks.nAcked)
+	}
+}
+
+func TestKafka_next(t *testing.T) {
+	t.Parallel()
+
+	t.Run("RedeliveryFirst", func(t *testing.T) {
+		ks := newTestKafka(10)
+		ks.redeliver(at(0, 7), 3)
+
+		// reader is never used when a redelivery is due.
+		msg, attempts, err := ks.next(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("next() unexpected error: %v", err)
+		}
+		if msg.Offset != 7 || attempts != 3 {
+			t.Errorf("next() = (offset %d, attempts %d), want (7, 3)", msg.Offset, attempts)
+		}
+	})
+
+	t.Run("WaitBoundedByRedelivery", func(t *testing.T) {
+		ks := newTestKafka(10)
+		ks.Backoff = retry.ConstBackoff(50 * time.Millisecond)
+		ks.redeliver(at(0, 7), 1)
+
+		// reader with an unreachable broker blocks until the redelivery is
+		// due instead of the parent ctx.
+		kr := kafka.NewReader(kafka.ReaderConfig{
+			Brokers: []string{"127.0.0.1:1"},
+			Topic:   "test",
+		})
+		defer kr.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		_, _, err := ks.next(ctx, kr)
+		if err != errInterrupted {
+			t.Errorf("next() error = %v, want %v", err, errInterrupted)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("next() blocked for %s, want about 50ms", elapsed)
+		}
+
+		msg, attempts, err := ks.next(ctx, kr)
+		if err != nil || msg.Offset != 7 || attempts != 1 {
+			t.Errorf("next() = (offset %d, attempts %d, %v), want (7, 1, nil)", msg.Offset, attempts, err)
+		}
+	})
+	t.Run("WokenByRedelivery", func(t *testing.T) {
+		ks := newTestKafka(10)
+		kr := kafka.NewReader(kafka.ReaderConfig{
+			Brokers: []string{"127.0.0.1:1"},
+			Topic:   "test",
+		})
+		defer kr.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// the message is either picked up directly or interrupts the fetch
+		// on the unreachable broker.
+		go ks.redeliver(at(0, 7), 1)
+
+		msg, attempts, err := ks.next(ctx, kr)
+		if err == errInterrupted {
+			msg, attempts, err = ks.next(ctx, kr)
+		}
+		if err != nil || msg.Offset != 7 || attempts != 1 {
+			t.Errorf("next() = (offset %d, attempts %d, %v), want (7, 1, nil)", msg.Offset, attempts, err)
+		}
+	})
+
+	t.Run("PausedWhenFull", func(t *testing.T) {
+		ks := newTestKafka(1)
+		ks.Backoff = retry.ConstBackoff(time.Hour)
+		ks.redeliver(at(0, 1), 1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		// reader is never used while the buffer is full.
+		_, _, err := ks.next(ctx, nil)
+		if err != context.DeadlineExceeded {
+			t.Errorf("next() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func newTestKafka(buffer int) *Kafka {
+	noLog := fusion.Log(func(_ map[string]interface{}) {})
+	return &Kafka{
+		RedeliveryBuffer: buffer,
+		log:              noLog,
+		hotLog:           noLog,
+		metrics:          fusion.MetricsFrom(context.Background()),
+		offsets:          newOffsetTracker(),
+		fetchSem:         make(chan struct{}, 1),
+		wake:             make(chan struct{}),
+	}
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// offsetTracker tracks in-flight messages per partition and decides the
+// offsets that are safe to commit. Offset of a partition is advanced only
+// up to the highest offset for which all the previous messages are acked.
+type offsetTracker struct {
+	mu    sync.Mutex
+	parts map[int]*partitionState
+}
+
+type partitionState struct {
+	last     int64
+	inFlight []*trackedMsg
+	byOffset map[int64]*trackedMsg
+	commit   *kafka.Message
+}
+
+type trackedMsg struct {
+	msg   kafka.Message
+	acked bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{parts: map[int]*partitionState{}}
+}
+
+// track registers the message as in-flight. Messages must be tracked in the
+// order they were fetched.
+func (ot *offsetTracker) track(msg kafka.Message) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	ps, found := ot.parts[msg.Partition]
+	if !found || msg.Offset <= ps.last {
+		// new partition or the partition was re-assigned/reset. offsets
+		// tracked so far are not valid anymore.
+		ps = &partitionState{byOffset: map[int64]*trackedMsg{}}
+		ot.parts[msg.Partition] = ps
+	}
+
+	tm := &trackedMsg{msg: msg}
+	ps.last = msg.Offset
+	ps.inFlight = append(ps.inFlight, tm)
+	ps.byOffset[msg.Offset] = tm
+}
+
+// ack marks the message as acknowledged and advances the commit offset of
+// the partition if possible.
+func (ot *offsetTracker) ack(msg kafka.Message) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	ps, found := ot.parts[msg.Partition]
+	if !found {
+		return
+	}
+
+	tm, found := ps.byOffset[msg.Offset]
+	if !found {
+		return
+	}
+	tm.acked = true
+
+	for len(ps.inFlight) > 0 && ps.inFlight[0].acked {
+		head := ps.inFlight[0]
+		ps.inFlight = ps.inFlight[1:]
+		delete(ps.byOffset, head.msg.Offset)
+		ps.commit = &head.msg
+	}
+}
+
+// committable returns the messages whose offsets should be committed (one
+// per partition) and resets them.
+func (ot *offsetTracker) committable() []kafka.Message {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	var msgs []kafka.Message
+	for _, ps := range ot.parts {
+		if ps.commit != nil {
+			msgs = append(msgs, *ps.commit)
+			ps.commit = nil
+		}
+	}
+	return msgs
+}
+
+// restore puts back the messages returned by committable if committing
+// them failed. Newer commit offsets, if any, are retained.
+func (ot *offsetTracker) restore(msgs []kafka.Message) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	for i, msg := range msgs {
+		ps, found := ot.parts[msg.Partition]
+		if found && ps.commit == nil && msg.Offset <= ps.last {
+			ps.commit = &msgs[i]
+		}
+	}
+}
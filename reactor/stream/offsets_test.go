@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		title string
+		track []kafka.Message
+		ack   []kafka.Message
+		want  map[int]int64
+	}{
+		{
+			title: "NothingAcked",
+			track: []kafka.Message{at(0, 1), at(0, 2)},
+			want:  map[int]int64{},
+		},
+		{
+			title: "InOrder",
+			track: []kafka.Message{at(0, 1), at(0, 2), at(0, 3)},
+			ack:   []kafka.Message{at(0, 1), at(0, 2)},
+			want:  map[int]int64{0: 2},
+		},
+		{
+			title: "OutOfOrderGap",
+			track: []kafka.Message{at(0, 1), at(0, 2), at(0, 3)},
+			ack:   []kafka.Message{at(0, 3), at(0, 2)},
+			want:  map[int]int64{},
+		},
+		{
+			title: "OutOfOrderFilled",
+			track: []kafka.Message{at(0, 1), at(0, 2), at(0, 3)},
+			ack:   []kafka.Message{at(0, 3), at(0, 1), at(0, 2)},
+			want:  map[int]int64{0: 3},
+		},
+		{
+			title: "OutOfOrderPartial",
+			track: []kafka.Message{at(0, 1), at(0, 2), at(0, 3)},
+			ack:   []kafka.Message{at(0, 3), at(0, 1)},
+			want:  map[int]int64{0: 1},
+		},
+		{
+			title: "Partitions",
+			track: []kafka.Message{at(0, 1), at(1, 5), at(0, 2), at(1, 6)},
+			ack:   []kafka.Message{at(0, 2), at(1, 5), at(1, 6)},
+			want:  map[int]int64{1: 6},
+		},
+		{
+			title: "UnknownAcks",
+			track: []kafka.Message{at(0, 1)},
+			ack:   []kafka.Message{at(0, 7), at(3, 1)},
+			want:  map[int]int64{},
+		},
+		{
+			title: "Reset",
+			track: []kafka.Message{at(0, 5), at(0, 6), at(0, 3), at(0, 4)},
+			ack:   []kafka.Message{at(0, 5), at(0, 6), at(0, 3)},
+			want:  map[int]int64{0: 3},
+		},
+		{
+			title: "ResetDropsPending",
+			track: []kafka.Message{at(0, 5), at(0, 6), at(0, 5)},
+			ack:   []kafka.Message{at(0, 6)},
+			want:  map[int]int64{},
+		},
+	}
+
+	for _, tt := range table {
+		tt := tt
+		t.Run(tt.title, func(t *testing.T) {
+			ot := newOffsetTracker()
+			for _, msg := range tt.track {
+				ot.track(msg)
+			}
+			for _, msg := range tt.ack {
+				ot.ack(msg)
+			}
+
+			if got := offsetsOf(ot.committable()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("committable() = %v, want %v", got, tt.want)
+			}
+			if got := ot.committable(); len(got) != 0 {
+				t.Errorf("committable() must be reset, got %v", offsetsOf(got))
+			}
+		})
+	}
+}
+
+func TestOffsetTracker_restore(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		title string
+		run   func(ot *offsetTracker)
+		want  map[int]int64
+	}{
+		{
+			title: "FailedCommit",
+			run: func(ot *offsetTracker) {
+				ot.track(at(0, 1))
+				ot.track(at(0, 2))
+				ot.ack(at(0, 1))
+				ot.restore(ot.committable())
+			},
+			want: map[int]int64{0: 1},
+		},
+		{
+			title: "Recommit",
+			run: func(ot *offsetTracker) {
+				ot.track(at(0, 1))
+				ot.track(at(0, 2))
+				ot.ack(at(0, 1))
+				ot.restore(ot.committable())
+				ot.committable() // re-commit succeeded.
+				ot.ack(at(0, 2))
+			},
+			want: map[int]int64{0: 2},
+		},
+		{
+			title: "RecommitNothingNew",
+			run: func(ot *offsetTracker) {
+				ot.track(at(0, 1))
+				ot.ack(at(0, 1))
+				ot.restore(ot.committable())
+				ot.committable() // re-commit succeeded.
+			},
+			want: map[int]int64{},
+		},
+		{
+			title: "NewerRetained",
+			run: func(ot *offsetTracker) {
+				ot.track(at(0, 1))
+				ot.track(at(0, 2))
+				ot.ack(at(0, 1))
+				msgs := ot.committable()
+				ot.ack(at(0, 2))
+				ot.restore(msgs)
+			},
+			want: map[int]int64{0: 2},
+		},
+		{
+			title: "AfterReset",
+			run: func(ot *offsetTracker) {
+				ot.track(at(0, 5))
+				ot.ack(at(0, 5))
+				msgs := ot.committable()
+				ot.track(at(0, 2))
+				ot.restore(msgs)
+			},
+			want: map[int]int64{},
+		},
+	}
+
+	for _, tt := range table {
+		tt := tt
+		t.Run(tt.title, func(t *testing.T) {
+			ot := newOffsetTracker()
+			tt.run(ot)
+
+			if got := offsetsOf(ot.committable()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("committable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func at(partition int, offset int64) kafka.Message {
+	return kafka.Message{Topic: "test", Partition: partition, Offset: offset}
+}
+
+func offsetsOf(msgs []kafka.Message) map[int]int64 {
+	offsets := map[int]int64{}
+	for _, msg := range msgs {
+		offsets[msg.Partition] = msg.Offset
+	}
+	return offsets
+}
@@ -0,0 +1,193 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/spy16/fusion"
+)
+
+var _ fusion.Proc = (*KafkaSink)(nil)
+
+// KafkaSink implements a fusion Proc that writes every message it receives to
+// a Kafka topic. It is meant to be used as the terminal step in a pipeline.
+// Messages are partitioned by Msg.Key and Msg.Attribs are sent as headers.
+// Upstream message is acknowledged only after the brokers confirm the write
+// and is nAcked with Retry if the write fails.
+type KafkaSink struct {
+	Topic   string   `json:"topic"`
+	Brokers []string `json:"brokers"`
+	Workers int      `json:"workers"`
+
+	// BatchSize is the maximum number of messages written in one request.
+	// BatchTimeout is the maximum time to wait for a batch to fill up.
+	// Defaults to 100 messages and 100ms.
+	BatchSize    int           `json:"batch_size"`
+	BatchTimeout time.Duration `json:"batch_timeout"`
+
+	// Compression can be one of gzip, snappy, lz4 or zstd. No compression
+	// is used if not set.
+	Compression string `json:"compression"`
+
+	// RequiredAcks is the number of replica acknowledgements required for
+	// a write to succeed. -1 waits for all in-sync replicas and is used if
+	// not set.
+	RequiredAcks int `json:"required_acks"`
+
+	log fusion.Log
+}
+
+// Run creates a Kafka writer and spawns the worker threads that batch the
+// messages from the stream and write them to Kafka. Run blocks until the
+// stream is closed or the ctx is cancelled.
+func (ks *KafkaSink) Run(ctx context.Context, stream <-chan fusion.Msg) error {
+	ks.log = fusion.LogFrom(ctx)
+	conf, err := ks.writerConfig()
+	if err != nil {
+		return err
+	}
+
+	writer := kafka.NewWriter(*conf)
+	defer func() { _ = writer.Close() }()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < ks.Workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			ks.sinkWorker(ctx, writer, stream)
+			ks.log.Infof("sink worker %d exited", id)
+		}(i)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (ks *KafkaSink) sinkWorker(ctx context.Context, writer *kafka.Writer, stream <-chan fusion.Msg) {
+	for {
+		batch, open := ks.nextBatch(ctx, stream)
+		if len(batch) > 0 {
+			ks.write(ctx, writer, batch)
+		}
+
+		if !open {
+			return
+		}
+	}
+}
+
+// nextBatch blocks for the first message and then collects messages until
+// the batch is full or the batch timeout elapses. Returns false when stream
+// is closed or ctx is cancelled.
+func (ks *KafkaSink) nextBatch(ctx context.Context, stream <-chan fusion.Msg) ([]fusion.Msg, bool) {
+	var batch []fusion.Msg
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case msg, open := <-stream:
+		if !open {
+			return nil, false
+		}
+		batch = append(batch, msg)
+	}
+
+	timeout := time.NewTimer(ks.BatchTimeout)
+	defer timeout.Stop()
+
+	for len(batch) < ks.BatchSize {
+		select {
+		case <-ctx.Done():
+			return batch, false
+		case <-timeout.C:
+			return batch, true
+		case msg, open := <-stream:
+			if !open {
+				return batch, false
+			}
+			batch = append(batch, msg)
+		}
+	}
+	return batch, true
+}
+
+func (ks *KafkaSink) write(ctx context.Context, writer *kafka.Writer, batch []fusion.Msg) {
+	tracer := fusion.TracerFrom(ctx)
+	spans := make([]fusion.Span, len(batch))
+	kMsgs := make([]kafka.Message, len(batch))
+	for i, msg := range batch {
+		kMsgs[i] = kafka.Message{Key: msg.Key, Value: msg.Val}
+		for k, v := range msg.Attribs {
+			if k != fusion.TraceParentAttrib {
+				kMsgs[i].Headers = append(kMsgs[i].Headers, kafka.Header{Key: k, Value: []byte(v)})
+			}
+		}
+
+		// continue the trace in the consumers of the topic.
+		spans[i] = tracer.Start("fusion.kafka_sink", fusion.ExtractTrace(msg))
+		if sc := spans[i].Context(); sc.IsValid() {
+			kMsgs[i].Headers = append(kMsgs[i].Headers, kafka.Header{
+				Key:   fusion.TraceParentAttrib,
+				Value: []byte(sc.String()),
+			})
+		}
+	}
+
+	var ackErr error
+	if err := writer.WriteMessages(ctx, kMsgs...); err != nil {
+		ks.log.Warnf("failed to write %d message(s) to kafka: %v", len(batch), err)
+		ackErr = fusion.Retry
+	}
+
+	for i, msg := range batch {
+		spans[i].End(ackErr)
+		msg.Ack(ackErr)
+	}
+}
+
+func (ks *KafkaSink) writerConfig() (*kafka.WriterConfig, error) {
+	if ks.Workers <= 0 {
+		ks.Workers = 1
+	}
+	if ks.BatchSize <= 0 {
+		ks.BatchSize = 100
+	}
+	if ks.BatchTimeout <= 0 {
+		ks.BatchTimeout = 100 * time.Millisecond
+	}
+	if ks.RequiredAcks == 0 {
+		ks.RequiredAcks = -1
+	}
+
+	conf := kafka.WriterConfig{
+		Brokers:   ks.Brokers,
+		Topic:     ks.Topic,
+		Balancer:  &kafka.Hash{},
+		BatchSize: ks.BatchSize,
+		// batching is done by the sink. writer should flush immediately.
+		BatchTimeout: time.Millisecond,
+		RequiredAcks: ks.RequiredAcks,
+	}
+
+	switch ks.Compression {
+	case "":
+	case "gzip":
+		conf.CompressionCodec = kafka.Gzip.Codec()
+	case "snappy":
+		conf.CompressionCodec = kafka.Snappy.Codec()
+	case "lz4":
+		conf.CompressionCodec = kafka.Lz4.Codec()
+	case "zstd":
+		conf.CompressionCodec = kafka.Zstd.Codec()
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", ks.Compression)
+	}
+
+	if len(conf.Brokers) == 0 || conf.Topic == "" {
+		return nil, errors.New("brokers and topic must be set")
+	}
+	return &conf, nil
+}
@@ -0,0 +1,145 @@
+package stream
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/spy16/fusion"
+)
+
+func TestKafkaSink_writerConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Defaults", func(t *testing.T) {
+		ks := &KafkaSink{Topic: "test", Brokers: []string{"localhost:9092"}}
+		conf, err := ks.writerConfig()
+		if err != nil {
+			t.Fatalf("writerConfig() unexpected error: %v", err)
+		}
+
+		if ks.Workers != 1 || ks.BatchSize != 100 || ks.BatchTimeout != 100*time.Millisecond || ks.RequiredAcks != -1 {
+			t.Errorf("writerConfig() defaults = (%d, %d, %s, %d), want (1, 100, 100ms, -1)",
+				ks.Workers, ks.BatchSize, ks.BatchTimeout, ks.RequiredAcks)
+		}
+		if conf.BatchSize != 100 || conf.RequiredAcks != -1 || conf.CompressionCodec != nil {
+			t.Errorf("writerConfig() = %+v, want batch size 100, all acks and no compression", conf)
+		}
+	})
+
+	t.Run("Compression", func(t *testing.T) {
+		for _, codec := range []string{"gzip", "snappy", "lz4", "zstd"} {
+			ks := &KafkaSink{Topic: "test", Brokers: []string{"localhost:9092"}, Compression: codec}
+			conf, err := ks.writerConfig()
+			if err != nil {
+				t.Errorf("writerConfig() unexpected error for '%s': %v", codec, err)
+			} else if conf.CompressionCodec == nil || conf.CompressionCodec.Name() != codec {
+				t.Errorf("writerConfig() codec = %v, want %s", conf.CompressionCodec, codec)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		table := map[string]*KafkaSink{
+			"UnknownCodec": {Topic: "test", Brokers: []string{"localhost:9092"}, Compression: "brotli"},
+			"NoBrokers":    {Topic: "test"},
+			"NoTopic":      {Brokers: []string{"localhost:9092"}},
+		}
+
+		for name, ks := range table {
+			if _, err := ks.writerConfig(); err == nil {
+				t.Errorf("%s: writerConfig() expected error, got nil", name)
+			}
+		}
+	})
+}
+
+func TestKafkaSink_nextBatch(t *testing.T) {
+	t.Parallel()
+
+	t.Run("BatchSize", func(t *testing.T) {
+		ks := &KafkaSink{BatchSize: 2, BatchTimeout: time.Hour}
+		stream := sinkStream(false, "a", "b", "c")
+
+		batch, open := ks.nextBatch(context.Background(), stream)
+		if want := []string{"a", "b"}; !open || !reflect.DeepEqual(keysOf(batch), want) {
+			t.Errorf("nextBatch() = (%v, %t), want (%v, true)", keysOf(batch), open, want)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		ks := &KafkaSink{BatchSize: 10, BatchTimeout: 10 * time.Millisecond}
+		stream := sinkStream(false, "a")
+
+		batch, open := ks.nextBatch(context.Background(), stream)
+		if want := []string{"a"}; !open || !reflect.DeepEqual(keysOf(batch), want) {
+			t.Errorf("nextBatch() = (%v, %t), want (%v, true)", keysOf(batch), open, want)
+		}
+	})
+
+	t.Run("StreamClosed", func(t *testing.T) {
+		ks := &KafkaSink{BatchSize: 10, BatchTimeout: time.Hour}
+
+		batch, open := ks.nextBatch(context.Background(), sinkStream(true, "a", "b"))
+		if want := []string{"a", "b"}; open || !reflect.DeepEqual(keysOf(batch), want) {
+			t.Errorf("nextBatch() = (%v, %t), want (%v, false)", keysOf(batch), open, want)
+		}
+
+		batch, open = ks.nextBatch(context.Background(), sinkStream(true))
+		if open || len(batch) != 0 {
+			t.Errorf("nextBatch() = (%v, %t), want ([], false)", keysOf(batch), open)
+		}
+	})
+}
+
+func TestKafkaSink_write(t *testing.T) {
+	t.Parallel()
+
+	ks := &KafkaSink{log: fusion.Log(func(_ map[string]interface{}) {})}
+
+	// a closed writer fails every write.
+	writer := kafka.NewWriter(kafka.WriterConfig{Brokers: []string{"127.0.0.1:1"}, Topic: "test"})
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	acks := map[string]error{}
+	var batch []fusion.Msg
+	for _, key := range []string{"a", "b"} {
+		key := key
+		batch = append(batch, fusion.Msg{
+			Key: []byte(key),
+			Ack: func(err error) { acks[key] = err },
+		})
+	}
+	ks.write(context.Background(), writer, batch)
+
+	want := map[string]error{"a": fusion.Retry, "b": fusion.Retry}
+	if !reflect.DeepEqual(acks, want) {
+		t.Errorf("acks = %v, want %v", acks, want)
+	}
+}
+
+// sinkStream returns a stream with messages for the keys. Stream is closed
+// after the messages if closed is set.
+func sinkStream(closed bool, keys ...string) <-chan fusion.Msg {
+	ch := make(chan fusion.Msg, len(keys))
+	for _, key := range keys {
+		ch <- fusion.Msg{Key: []byte(key)}
+	}
+	if closed {
+		close(ch)
+	}
+	return ch
+}
+
+func keysOf(batch []fusion.Msg) []string {
+	var keys []string
+	for _, msg := range batch {
+		keys = append(keys, string(msg.Key))
+	}
+	return keys
+}
@@ -12,12 +12,24 @@ import (
 
 var _ DelayQueue = (*InMemQ)(nil)
 
+// ErrNoMessage is returned by DelayQueue implementations from Dequeue when
+// there are messages in the queue but none of them is ready yet.
+var ErrNoMessage = errors.New("no message")
+
 // Item is maintained by the delay queue and tracks the retries done etc.
 type Item struct {
 	Message     fusion.Msg `json:"message"`
 	Attempts    int        `json:"attempts"`
 	NextAttempt time.Time  `json:"next_attempt"`
 	LastAttempt time.Time  `json:"last_attempt"`
+	ReceivedAt  time.Time  `json:"received_at,omitempty"`
+
+	// Cause is set once the message has failed for good but could not be
+	// saved to the dead letter yet. Such items are not sent to the Proc
+	// again, only the dead letter write is retried. Failed is set if the
+	// message was failed with fusion.Fail instead of exhausting retries.
+	Cause  string `json:"cause,omitempty"`
+	Failed bool   `json:"failed,omitempty"`
 }
 
 // DelayQueue implementation maintains the messages in a timestamp based order.
@@ -56,24 +68,27 @@ func (q *InMemQ) Enqueue(item Item) error {
 }
 
 // Dequeue reads a message from the in-mem heap if available and calls readFn with
-// it. Otherwise returns ErrNoMessage.
+// it. Returns io.EOF if the queue is empty and ErrNoMessage if none of the items
+// are ready yet.
 func (q *InMemQ) Dequeue(ctx context.Context, readFn ReadFn) error {
-	if q.size() == 0 {
-		return io.EOF
-	}
-
-	item := q.pop()
-	if item == nil {
-		return errors.New("no message")
+	item, err := q.pop()
+	if err != nil {
+		return err
 	}
 
-	err := readFn(ctx, *item)
-	if err != nil {
+	if err := readFn(ctx, *item); err != nil {
 		q.push(*item) // failed to read. put it back.
 	}
 	return nil
 }
 
+// Len returns the number of items in the queue.
+func (q *InMemQ) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size()
+}
+
 func (q *InMemQ) push(item Item) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -82,19 +97,21 @@ func (q *InMemQ) push(item Item) {
 	q.heapifyUp(q.size() - 1)
 }
 
-func (q *InMemQ) pop() *Item {
+func (q *InMemQ) pop() (*Item, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	if q.size() == 0 || !q.items[0].NextAttempt.Before(time.Now()) {
-		return nil
+	if q.size() == 0 {
+		return nil, io.EOF
+	} else if q.items[0].NextAttempt.After(time.Now()) {
+		return nil, ErrNoMessage
 	}
 
 	m := q.items[0]
 	q.swap(0, q.size()-1)
 	q.items = q.items[:q.size()-1]
 	q.heapifyDown(0)
-	return &m
+	return &m, nil
 }
 
 func (q *InMemQ) size() int { return len(q.items) }
@@ -112,19 +129,17 @@ func (q *InMemQ) heapifyUp(index int) {
 }
 
 func (q *InMemQ) heapifyDown(index int) {
-	rightChildAt := q.rightChild(index)
-	leftChildAt := q.leftChild(index)
-
-	if index < q.size() && leftChildAt < q.size() && rightChildAt < q.size() {
-		parent := q.items[index]
-		if parent.NextAttempt.After(q.items[rightChildAt].NextAttempt) {
-			q.swap(rightChildAt, index)
-			q.heapifyDown(rightChildAt)
-		} else if parent.NextAttempt.After(q.items[leftChildAt].NextAttempt) {
-			q.swap(leftChildAt, index)
-			q.heapifyDown(leftChildAt)
+	smallest := index
+	for _, child := range []int{q.leftChild(index), q.rightChild(index)} {
+		if child < q.size() && q.items[child].NextAttempt.Before(q.items[smallest].NextAttempt) {
+			smallest = child
 		}
 	}
+
+	if smallest != index {
+		q.swap(smallest, index)
+		q.heapifyDown(smallest)
+	}
 }
 
 func (q *InMemQ) swap(i, j int) {
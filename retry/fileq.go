@@ -0,0 +1,235 @@
+package retry
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spy16/fusion/internal/applog"
+)
+
+var _ DelayQueue = (*FileQ)(nil)
+
+const (
+	opPut = "put"
+	opDel = "del"
+
+	// compactMin is the minimum number of records in the log before it is
+	// considered for compaction.
+	compactMin = 1024
+)
+
+// FileQ implements a persistent DelayQueue using an append-only log file and
+// an in-memory index. Every enqueue appends the item to the log and every
+// successful dequeue appends a tombstone. Items that were being processed
+// when the process crashed will be re-delivered after restart. The log is
+// compacted once acknowledged items make up more than half of it. Enqueues
+// are fsync'd before returning while tombstones are not, so a crash of the
+// host may only cause acknowledged items to be re-delivered.
+type FileQ struct {
+	mu      sync.Mutex
+	log     *applog.File
+	nextID  uint64
+	records int
+	items   map[uint64]Item
+	ready   idHeap
+}
+
+// OpenFileQ opens the queue log at path (creating it if required) and restores
+// all the pending items from it.
+func OpenFileQ(path string) (*FileQ, error) {
+	q := &FileQ{items: map[uint64]Item{}}
+	q.ready.items = q.items
+
+	log, err := applog.Open(path, q.restore)
+	if err != nil {
+		return nil, err
+	}
+	q.log = log
+
+	for id := range q.items {
+		heap.Push(&q.ready, id)
+	}
+	return q, nil
+}
+
+// Enqueue appends the item to the log and indexes it with NextAttempt as the
+// priority. If NextAttempt is not set, current timestamp will be assumed.
+func (q *FileQ) Enqueue(item Item) error {
+	if item.NextAttempt.IsZero() {
+		item.NextAttempt = time.Now()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.log == nil {
+		return os.ErrClosed
+	}
+
+	q.nextID++
+	id := q.nextID
+	if err := q.append(record{Op: opPut, ID: id, Item: &item}, true); err != nil {
+		return err
+	}
+	q.items[id] = item
+	heap.Push(&q.ready, id)
+	return nil
+}
+
+// Dequeue reads the earliest ready item and calls readFn with it. Item is
+// removed from the log only if readFn succeeds. Returns io.EOF if the queue
+// is empty and ErrNoMessage if none of the items are ready yet.
+func (q *FileQ) Dequeue(ctx context.Context, readFn ReadFn) error {
+	id, item, err := q.pop()
+	if err != nil {
+		return err
+	}
+
+	if err := readFn(ctx, item); err != nil {
+		q.mu.Lock()
+		heap.Push(&q.ready, id) // failed to read. put it back.
+		q.mu.Unlock()
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.items, id)
+	if q.log == nil {
+		return os.ErrClosed
+	}
+
+	if err := q.append(record{Op: opDel, ID: id}, false); err != nil {
+		return err
+	}
+	return q.maybeCompact()
+}
+
+// Len returns the number of items in the queue including the ones that are
+// currently being processed.
+func (q *FileQ) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Close flushes the log to disk and closes it. Queue must not be used after
+// Close.
+func (q *FileQ) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.log == nil {
+		return nil
+	}
+
+	err := q.log.Close()
+	q.log = nil
+	return err
+}
+
+func (q *FileQ) pop() (uint64, Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return 0, Item{}, io.EOF
+	} else if q.ready.Len() == 0 || q.items[q.ready.ids[0]].NextAttempt.After(time.Now()) {
+		return 0, Item{}, ErrNoMessage
+	}
+
+	id := heap.Pop(&q.ready).(uint64)
+	return id, q.items[id], nil
+}
+
+func (q *FileQ) append(rec record, sync bool) error {
+	if err := q.log.Append(rec, sync); err != nil {
+		return err
+	}
+	q.records++
+	return nil
+}
+
+func (q *FileQ) maybeCompact() error {
+	if q.records < compactMin || len(q.items)*2 > q.records {
+		return nil
+	}
+
+	err := q.log.Rewrite(func(enc *json.Encoder) error {
+		for id, item := range q.items {
+			item := item
+			if err := enc.Encode(record{Op: opPut, ID: id, Item: &item}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.records = len(q.items)
+	return nil
+}
+
+// restore applies a record read from the log while opening the queue.
+func (q *FileQ) restore(line []byte) error {
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	} else if rec.Op == opPut && rec.Item == nil {
+		return errors.New("no item")
+	}
+	q.records++
+
+	if rec.ID > q.nextID {
+		q.nextID = rec.ID
+	}
+
+	switch rec.Op {
+	case opPut:
+		q.items[rec.ID] = *rec.Item
+
+	case opDel:
+		delete(q.items, rec.ID)
+
+	default:
+		return fmt.Errorf("unknown op '%s'", rec.Op)
+	}
+	return nil
+}
+
+type record struct {
+	Op   string `json:"op"`
+	ID   uint64 `json:"id"`
+	Item *Item  `json:"item,omitempty"`
+}
+
+// idHeap implements heap.Interface for item ids ordered by NextAttempt.
+type idHeap struct {
+	ids   []uint64
+	items map[uint64]Item
+}
+
+func (h idHeap) Len() int { return len(h.ids) }
+
+func (h idHeap) Less(i, j int) bool {
+	return h.items[h.ids[i]].NextAttempt.Before(h.items[h.ids[j]].NextAttempt)
+}
+
+func (h idHeap) Swap(i, j int) { h.ids[i], h.ids[j] = h.ids[j], h.ids[i] }
+
+func (h *idHeap) Push(x interface{}) { h.ids = append(h.ids, x.(uint64)) }
+
+func (h *idHeap) Pop() interface{} {
+	id := h.ids[len(h.ids)-1]
+	h.ids = h.ids[:len(h.ids)-1]
+	return id
+}
@@ -0,0 +1,124 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestFileQ(t *testing.T) {
+	t.Parallel()
+
+	t.Run("EnqueueDequeue", func(t *testing.T) {
+		q, _ := openTestQ(t)
+		defer q.Close()
+
+		assert.Equal(t, io.EOF, q.Dequeue(context.Background(), nil))
+
+		at := time.Now()
+		noErr(t, q.Enqueue(Item{Message: fusion.Msg{Key: []byte("later")}, NextAttempt: at.Add(1 * time.Hour)}))
+		noErr(t, q.Enqueue(Item{Message: fusion.Msg{Key: []byte("now")}, NextAttempt: at}))
+
+		var got []byte
+		noErr(t, q.Dequeue(context.Background(), func(ctx context.Context, item Item) error {
+			got = item.Message.Key
+			return nil
+		}))
+		assert.Equal(t, []byte("now"), got)
+		assert.Equal(t, ErrNoMessage, q.Dequeue(context.Background(), nil))
+		assert.Equal(t, 1, q.Len())
+	})
+
+	t.Run("SurvivesReopen", func(t *testing.T) {
+		q, path := openTestQ(t)
+
+		msg := fusion.Msg{Key: []byte("k"), Val: []byte("v"), Attribs: map[string]string{"a": "b"}}
+		noErr(t, q.Enqueue(Item{Message: msg, Attempts: 2}))
+		noErr(t, q.Enqueue(Item{Message: fusion.Msg{Key: []byte("acked")}, NextAttempt: time.Now().Add(-1 * time.Hour)}))
+		noErr(t, q.Dequeue(context.Background(), func(ctx context.Context, item Item) error {
+			return nil
+		}))
+
+		// nAcked items must remain in the queue.
+		noErr(t, q.Dequeue(context.Background(), func(ctx context.Context, item Item) error {
+			return errors.New("failed")
+		}))
+		noErr(t, q.Close())
+
+		q, err := OpenFileQ(path)
+		require.NoError(t, err)
+		defer q.Close()
+
+		require.Equal(t, 1, q.Len())
+		noErr(t, q.Dequeue(context.Background(), func(ctx context.Context, item Item) error {
+			assert.Equal(t, msg.Key, item.Message.Key)
+			assert.Equal(t, msg.Val, item.Message.Val)
+			assert.Equal(t, msg.Attribs, item.Message.Attribs)
+			assert.Equal(t, 2, item.Attempts)
+			return nil
+		}))
+		assert.Equal(t, 0, q.Len())
+	})
+
+	t.Run("PartialRecord", func(t *testing.T) {
+		q, path := openTestQ(t)
+		noErr(t, q.Enqueue(Item{Message: fusion.Msg{Key: []byte("k")}}))
+		noErr(t, q.Close())
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"op":"put","id":2,"it`)
+		require.NoError(t, err)
+		noErr(t, f.Close())
+
+		q, err = OpenFileQ(path)
+		require.NoError(t, err)
+		assert.Equal(t, 1, q.Len())
+		noErr(t, q.Enqueue(Item{Message: fusion.Msg{Key: []byte("k2")}}))
+		noErr(t, q.Close())
+
+		q, err = OpenFileQ(path)
+		require.NoError(t, err)
+		defer q.Close()
+		assert.Equal(t, 2, q.Len())
+	})
+
+	t.Run("Compaction", func(t *testing.T) {
+		q, path := openTestQ(t)
+		defer q.Close()
+
+		for i := 0; i < compactMin; i++ {
+			noErr(t, q.Enqueue(Item{}))
+			noErr(t, q.Dequeue(context.Background(), func(ctx context.Context, item Item) error {
+				return nil
+			}))
+		}
+		noErr(t, q.Enqueue(Item{}))
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		assert.True(t, len(data) < 1024)
+		assert.Equal(t, 1, q.Len())
+	})
+}
+
+func openTestQ(t *testing.T) (*FileQ, string) {
+	dir, err := ioutil.TempDir("", "fileq")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "queue.log")
+	q, err := OpenFileQ(path)
+	require.NoError(t, err)
+	return q, path
+}
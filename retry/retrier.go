@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spy16/fusion"
@@ -37,57 +38,243 @@ type Retrier struct {
 	EnqueueWorkers int
 
 	// ProcWorkers is the number of main worker threads to use for running
-	// proc.
+	// proc. Each worker dispatches one message at a time to the Proc and
+	// waits for it to be acknowledged, so this is also the upper bound on
+	// messages in-flight in the Proc. Defaults to 1.
 	ProcWorkers int
 
+	// PollInterval is the time to wait before polling the queue again when
+	// no messages are ready. Defaults to 100ms.
+	PollInterval time.Duration
+
 	// OnFailure is called when a message fails and exhausts all retries.
 	// If not set, such messages will be logged and discarded.
 	OnFailure func(item Item)
 
+	// DeadLetter can be set to save messages that exhaust all retries or
+	// are failed with fusion.Fail. If saving fails, the write is retried
+	// with backoff up to MaxRetries times, after which the item is put
+	// back in the queue to be saved later. The Proc is not run again for
+	// such messages.
+	DeadLetter fusion.DeadLetter
+
 	// Log can be set to customise logging mechanism used by retrier. If
 	// not set, logging will be disabled.
 	Log fusion.Log
+
+	// Metrics can be set to customise the metrics used by retrier. If not
+	// set, metrics set on the Runner will be used.
+	Metrics fusion.Metrics
+
+	pending int64
 }
 
 // Run starts the proc workers and the retry worker threads and blocks until
-// all the workers return.
+// all the workers return. Run returns once the stream is closed and all the
+// messages have either succeeded or exhausted their retries, or when the ctx
+// is cancelled.
 func (ret *Retrier) Run(ctx context.Context, stream <-chan fusion.Msg) error {
 	if err := ret.init(); err != nil {
 		return err
 	}
 
-	wg := &sync.WaitGroup{}
+	if ret.Metrics == nil {
+		ret.Metrics = fusion.MetricsFrom(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	procCh := make(chan fusion.Msg)
+	procErr := make(chan error, 1)
+	go func() {
+		defer cancel() // proc exited, stop all workers.
+		procErr <- ret.Proc.Run(ctx, procCh)
+	}()
+
+	enqueueWg := &sync.WaitGroup{}
 	for i := 0; i < ret.EnqueueWorkers; i++ {
-		wg.Add(1)
+		enqueueWg.Add(1)
 		go func(id int) {
-			defer wg.Done()
+			defer enqueueWg.Done()
 			ret.enqueueWorker(ctx, stream)
 		}(i)
 	}
 
-	// TODO: co-ordinate these 2 workers better.
+	streamDone := make(chan struct{})
+	go func() {
+		enqueueWg.Wait()
+		close(streamDone)
+	}()
 
+	procWg := &sync.WaitGroup{}
 	for i := 0; i < ret.ProcWorkers; i++ {
-		wg.Add(1)
+		procWg.Add(1)
 		go func(id int) {
-			defer wg.Done()
-			ret.procWorker(ctx)
+			defer procWg.Done()
+			ret.procWorker(ctx, procCh, streamDone)
 		}(i)
 	}
-	wg.Wait()
+	procWg.Wait()
+	<-streamDone
+
+	close(procCh)
+	err := <-procErr
+
+	if closer, ok := ret.Queue.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			ret.Log.Warnf("failed to close queue: %v", closeErr)
+		}
+	}
+	return err
+}
+
+func (ret *Retrier) procWorker(ctx context.Context, procCh chan<- fusion.Msg, streamDone <-chan struct{}) {
+	readFn := func(ctx context.Context, item Item) error {
+		return ret.dispatch(ctx, procCh, item)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-streamDone:
+			if atomic.LoadInt64(&ret.pending) == 0 {
+				return
+			}
+		default:
+		}
+
+		err := ret.Queue.Dequeue(ctx, readFn)
+		if sizer, ok := ret.Queue.(interface{ Len() int }); ok {
+			ret.Metrics.Gauge("fusion_retry_queue_size", float64(sizer.Len()), nil)
+		}
+
+		if err == nil {
+			continue
+		} else if err != io.EOF && err != ErrNoMessage {
+			ret.Log.Warnf("failed to dequeue: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ret.PollInterval):
+		}
+	}
+}
+
+// dispatch sends the message in the item to the proc and blocks until it is
+// acknowledged. Returns error only if the item should be retained in the
+// queue as is. Items that have already failed are only saved to the dead
+// letter.
+func (ret *Retrier) dispatch(ctx context.Context, procCh chan<- fusion.Msg, item Item) error {
+	if item.Cause != "" {
+		return ret.bury(ctx, item)
+	}
+
+	result := make(chan error, 1)
+	once := &sync.Once{}
+
+	msg := item.Message
+	msg.Ack = func(err error) {
+		once.Do(func() { result <- err })
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case procCh <- msg:
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-result:
+		return ret.handleResult(ctx, item, err)
+	}
+}
+
+func (ret *Retrier) handleResult(ctx context.Context, item Item, err error) error {
+	ret.Metrics.Count("fusion_retry_attempts_total", 1, map[string]string{
+		"result": fusion.ResultLabel(err),
+	})
 
+	if err == nil || err == fusion.Skip {
+		atomic.AddInt64(&ret.pending, -1)
+		return nil
+	}
+
+	item.Attempts++
+	item.LastAttempt = time.Now()
+	if err == fusion.Fail || item.Attempts > ret.MaxRetries {
+		item.Cause = err.Error()
+		item.Failed = err == fusion.Fail
+		return ret.bury(ctx, item)
+	}
+
+	item.NextAttempt = item.LastAttempt.Add(ret.Backoff.RetryAfter(item.Attempts))
+	return ret.reEnqueue(ctx, item)
+}
+
+// bury saves the failed item to the dead letter and discards it. Failed
+// writes are retried with backoff up to MaxRetries times. If the write still
+// fails or ctx is cancelled, the item is re-enqueued with its Cause so that
+// only the write is attempted again later and the worker is not blocked by
+// an unavailable dead letter.
+func (ret *Retrier) bury(ctx context.Context, item Item) error {
+	for i := 1; ; i++ {
+		if err := ret.toDeadLetter(item); err == nil {
+			break
+		} else if i > ret.MaxRetries || !sleep(ctx, ret.Backoff.RetryAfter(i)) {
+			item.NextAttempt = time.Now().Add(ret.Backoff.RetryAfter(i))
+			return ret.Queue.Enqueue(item)
+		}
+	}
+
+	if item.Failed {
+		ret.Log.With(map[string]interface{}{"item": item}).Warnf("message failed, discarding item.")
+	} else {
+		ret.Metrics.Count("fusion_retry_exhausted_total", 1, nil)
+		ret.OnFailure(item)
+	}
+	atomic.AddInt64(&ret.pending, -1)
 	return nil
 }
 
-func (ret *Retrier) procWorker(ctx context.Context) {
-	_ = ret.Queue.Dequeue(ctx, func(ctx context.Context, item Item) error {
-		if item.Attempts >= ret.MaxRetries {
-			ret.OnFailure(item)
+// reEnqueue pushes the item back into the queue for the next attempt. Failed
+// enqueues are retried with backoff until ctx is cancelled, after which the
+// error is returned so that the queue retains the original item.
+func (ret *Retrier) reEnqueue(ctx context.Context, item Item) error {
+	for i := 1; ; i++ {
+		err := ret.Queue.Enqueue(item)
+		if err == nil {
+			return nil
 		}
+		ret.Log.Warnf("failed to re-enqueue item: %v", err)
 
-		// TODO: invoke proc.
+		if !sleep(ctx, ret.Backoff.RetryAfter(i)) {
+			return err
+		}
+	}
+}
+
+func (ret *Retrier) toDeadLetter(item Item) error {
+	if ret.DeadLetter == nil {
 		return nil
+	}
+
+	err := ret.DeadLetter.Put(context.Background(), fusion.DeadMsg{
+		Msg:        item.Message,
+		Error:      item.Cause,
+		Attempts:   item.Attempts,
+		ReceivedAt: item.ReceivedAt,
+		FailedAt:   item.LastAttempt,
 	})
+	if err != nil {
+		ret.Log.Warnf("failed to write to dead letter: %v", err)
+	}
+	return err
 }
 
 func (ret *Retrier) enqueueWorker(ctx context.Context, stream <-chan fusion.Msg) {
@@ -98,22 +285,39 @@ func (ret *Retrier) enqueueWorker(ctx context.Context, stream <-chan fusion.Msg)
 
 		case msg, open := <-stream:
 			if !open {
-				if closer, ok := ret.Queue.(io.Closer); ok {
-					_ = closer.Close()
-				}
 				return
 			}
 
+			now := time.Now()
+			item := Item{
+				Message:     msg,
+				ReceivedAt:  now,
+				NextAttempt: now, // queue for immediate attempt.
+			}
+			item.Message.Ack = nil
+
 			// move this item to the delay queue and acknowledge the
 			// stream if it succeeded/failed.
-			msg.Ack(ret.Queue.Enqueue(Item{
-				Message:     msg,
-				NextAttempt: time.Now(), // queue for immediate attempt.
-			}))
+			atomic.AddInt64(&ret.pending, 1)
+			err := ret.Queue.Enqueue(item)
+			if err != nil {
+				atomic.AddInt64(&ret.pending, -1)
+			}
+			msg.Ack(err)
 		}
 	}
 }
 
+// sleep waits for the duration and returns false if ctx is cancelled before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
 func (ret *Retrier) init() error {
 	if ret.Proc == nil {
 		return errors.New("proc must be set")
@@ -127,6 +331,14 @@ func (ret *Retrier) init() error {
 		ret.EnqueueWorkers = 1
 	}
 
+	if ret.ProcWorkers <= 0 {
+		ret.ProcWorkers = 1
+	}
+
+	if ret.PollInterval <= 0 {
+		ret.PollInterval = 100 * time.Millisecond
+	}
+
 	if ret.Queue == nil {
 		ret.Queue = &InMemQ{}
 	}
@@ -141,11 +353,7 @@ func (ret *Retrier) init() error {
 
 	if ret.OnFailure == nil {
 		ret.OnFailure = func(item Item) {
-			ret.Log(map[string]interface{}{
-				"level":   "warn",
-				"item":    item,
-				"message": "retry exhausted, discarding item.",
-			})
+			ret.Log.With(map[string]interface{}{"item": item}).Warnf("retry exhausted, discarding item.")
 		}
 	}
 	return nil
@@ -1 +1,281 @@
 package retry_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/retry"
+)
+
+func TestRetrier_Run(t *testing.T) {
+	t.Parallel()
+
+	t.Run("NoProc", func(t *testing.T) {
+		ret := &retry.Retrier{}
+		assert.Error(t, ret.Run(context.Background(), nil))
+	})
+
+	t.Run("RetryUntilSuccess", func(t *testing.T) {
+		calls := 0
+		ret := &retry.Retrier{
+			Backoff:      retry.ConstBackoff(10 * time.Millisecond),
+			PollInterval: 5 * time.Millisecond,
+			Proc: &fusion.Fn{
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					calls++
+					if calls < 3 {
+						return fusion.Retry
+					}
+					return nil
+				},
+			},
+			OnFailure: func(item retry.Item) {
+				t.Errorf("OnFailure() must not be called, got %+v", item)
+			},
+		}
+
+		err := ret.Run(context.Background(), streamOf(fusion.Msg{Key: []byte("k")}))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("RetriesExhausted", func(t *testing.T) {
+		calls := 0
+		var failed []retry.Item
+		ret := &retry.Retrier{
+			MaxRetries:   2,
+			Backoff:      retry.ConstBackoff(1 * time.Millisecond),
+			PollInterval: 5 * time.Millisecond,
+			Proc: &fusion.Fn{
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					calls++
+					return fusion.Retry
+				},
+			},
+			OnFailure: func(item retry.Item) { failed = append(failed, item) },
+		}
+
+		err := ret.Run(context.Background(), streamOf(fusion.Msg{Key: []byte("k")}))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+		if assert.Len(t, failed, 1) {
+			assert.Equal(t, 3, failed[0].Attempts)
+			assert.Equal(t, []byte("k"), failed[0].Message.Key)
+		}
+	})
+
+	t.Run("FailAndSkipTerminate", func(t *testing.T) {
+		mu := sync.Mutex{}
+		calls := map[string]int{}
+		ret := &retry.Retrier{
+			ProcWorkers:  2,
+			PollInterval: 5 * time.Millisecond,
+			Proc: &fusion.Fn{
+				Workers: 2,
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					mu.Lock()
+					defer mu.Unlock()
+					calls[string(msg.Key)]++
+					if string(msg.Key) == "fail" {
+						return fusion.Fail
+					}
+					return fusion.Skip
+				},
+			},
+			OnFailure: func(item retry.Item) {
+				t.Errorf("OnFailure() must not be called, got %+v", item)
+			},
+		}
+
+		err := ret.Run(context.Background(), streamOf(
+			fusion.Msg{Key: []byte("fail")},
+			fusion.Msg{Key: []byte("skip")},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"fail": 1, "skip": 1}, calls)
+	})
+}
+
+func streamOf(messages ...fusion.Msg) <-chan fusion.Msg {
+	ch := make(chan fusion.Msg, len(messages))
+	for _, msg := range messages {
+		msg.Ack = func(_ error) {}
+		ch <- msg
+	}
+	close(ch)
+	return ch
+}
+
+func TestRetrier_Run_DeadLetter(t *testing.T) {
+	dl := &fusion.MemDeadLetter{}
+	ret := &retry.Retrier{
+		MaxRetries:   1,
+		DeadLetter:   dl,
+		Backoff:      retry.ConstBackoff(1 * time.Millisecond),
+		PollInterval: 5 * time.Millisecond,
+		Proc: &fusion.Fn{
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				if string(msg.Key) == "fail" {
+					return fusion.Fail
+				}
+				return fusion.Retry
+			},
+		},
+	}
+
+	err := ret.Run(context.Background(), streamOf(
+		fusion.Msg{Key: []byte("fail")},
+		fusion.Msg{Key: []byte("retry")},
+	))
+	assert.NoError(t, err)
+
+	attempts := map[string]int{}
+	for _, dm := range dl.Msgs() {
+		attempts[string(dm.Msg.Key)] = dm.Attempts
+	}
+	assert.Equal(t, map[string]int{"fail": 1, "retry": 2}, attempts)
+}
+
+func TestRetrier_Run_EnqueueFailure(t *testing.T) {
+	calls := 0
+	q := &flakyQueue{InMemQ: &retry.InMemQ{}, failures: 2}
+	ret := &retry.Retrier{
+		Queue:        q,
+		Backoff:      retry.ConstBackoff(5 * time.Millisecond),
+		PollInterval: 5 * time.Millisecond,
+		Proc: &fusion.Fn{
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				calls++
+				if calls < 2 {
+					return fusion.Retry
+				}
+				return nil
+			},
+		},
+	}
+
+	err := ret.Run(context.Background(), streamOf(fusion.Msg{Key: []byte("k")}))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 0, q.failures)
+}
+
+// flakyQueue fails the given number of re-enqueues (i.e., items with
+// attempts) before delegating to the in-memory queue.
+type flakyQueue struct {
+	*retry.InMemQ
+	failures int
+}
+
+func (q *flakyQueue) Enqueue(item retry.Item) error {
+	if item.Attempts > 0 && q.failures > 0 {
+		q.failures--
+		return errors.New("queue unavailable")
+	}
+	return q.InMemQ.Enqueue(item)
+}
+
+func TestRetrier_Run_DeadLetterFailure(t *testing.T) {
+	calls := 0
+	puts := 0
+	var got []fusion.DeadMsg
+	ret := &retry.Retrier{
+		Backoff:      retry.ConstBackoff(1 * time.Millisecond),
+		PollInterval: 5 * time.Millisecond,
+		DeadLetter: fusion.DeadLetterFn(func(ctx context.Context, dm fusion.DeadMsg) error {
+			puts++
+			if puts <= 2 {
+				return errors.New("dead letter unavailable")
+			}
+			got = append(got, dm)
+			return nil
+		}),
+		Proc: &fusion.Fn{
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				calls++
+				return fusion.Fail
+			},
+		},
+	}
+
+	err := ret.Run(context.Background(), streamOf(fusion.Msg{Key: []byte("fail")}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 3, puts)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, fusion.Fail.Error(), got[0].Error)
+		assert.Equal(t, 1, got[0].Attempts)
+		assert.False(t, got[0].ReceivedAt.IsZero())
+		assert.False(t, got[0].FailedAt.Before(got[0].ReceivedAt))
+	}
+}
+
+func TestRetrier_Run_DeadLetterDown(t *testing.T) {
+	mu := sync.Mutex{}
+	calls := map[string]int{}
+	done := make(chan struct{})
+
+	q := &retry.InMemQ{}
+	ret := &retry.Retrier{
+		Queue:        q,
+		MaxRetries:   1,
+		Backoff:      retry.ConstBackoff(1 * time.Millisecond),
+		PollInterval: 5 * time.Millisecond,
+		DeadLetter: fusion.DeadLetterFn(func(ctx context.Context, dm fusion.DeadMsg) error {
+			return errors.New("dead letter unavailable")
+		}),
+		Proc: &fusion.Fn{
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				mu.Lock()
+				defer mu.Unlock()
+				calls[string(msg.Key)]++
+				if string(msg.Key) == "fail" {
+					return fusion.Fail
+				}
+				close(done)
+				return nil
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- ret.Run(ctx, streamOf(fusion.Msg{Key: []byte("fail")}, fusion.Msg{Key: []byte("ok")}))
+	}()
+
+	// the failed item must not block the worker while the dead letter is
+	// unavailable.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message stuck behind the failed one")
+	}
+	cancel()
+	assert.NoError(t, <-runErr)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"fail": 1, "ok": 1}, calls)
+
+	// failed item is retained for the dead letter write to be retried.
+	var item retry.Item
+	readFn := func(ctx context.Context, it retry.Item) error {
+		item = it
+		return nil
+	}
+	for q.Dequeue(context.Background(), readFn) == retry.ErrNoMessage {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []byte("fail"), item.Message.Key)
+	assert.Equal(t, fusion.Fail.Error(), item.Cause)
+	assert.True(t, item.Failed)
+}
@@ -0,0 +1,235 @@
+package fusion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var _ Proc = (*Router)(nil)
+
+// Router implements a Proc that dispatches each message to the Proc of the
+// first route that matches it. Routes run concurrently and independently,
+// each with its own stream, so a slow route holds up the others only once
+// its Buffer is full. Messages that match no route are sent to Default or
+// are acked with NoMatchAck if Default is not set.
+type Router struct {
+	// Routes in the order of evaluation.
+	Routes []Route
+
+	// Default is the Proc for the messages that match none of the routes.
+	Default Proc
+
+	// NoMatchAck is the ack for the messages that match none of the routes
+	// when Default is not set. Defaults to Skip.
+	NoMatchAck error
+}
+
+// Route of the Router.
+type Route struct {
+	// Name of the route used in logs and metrics. Defaults to the index of
+	// the route.
+	Name string
+
+	// Match returns true if the message should be sent to this route. Use
+	// MatchKeyPrefix, MatchAttrib or MatchJSONField for common cases.
+	Match func(msg Msg) bool
+
+	// Proc to process the messages of this route. If not set, Func and
+	// Workers are used to create a Fn instead.
+	Proc Proc
+
+	// Func and Workers define the Fn for this route when Proc is not set.
+	// Workers controls the concurrency of the route and defaults to 1.
+	Func    func(ctx context.Context, msg Msg) error
+	Workers int
+
+	// Buffer is the number of messages that can be queued for the route
+	// without blocking the other routes.
+	Buffer int
+}
+
+// MatchKeyPrefix returns a matcher for messages with the key prefix.
+func MatchKeyPrefix(prefix string) func(msg Msg) bool {
+	return func(msg Msg) bool { return strings.HasPrefix(string(msg.Key), prefix) }
+}
+
+// MatchAttrib returns a matcher for messages with the attribute set to one of
+// the values. If no values are given, messages with the attribute set to any
+// value match.
+func MatchAttrib(name string, values ...string) func(msg Msg) bool {
+	return func(msg Msg) bool {
+		v, found := msg.Attribs[name]
+		if !found || len(values) == 0 {
+			return found
+		}
+		for _, want := range values {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchJSONField returns a matcher for messages with JSON object value in
+// which the field has the given value. Field can be a dot-separated path to
+// a nested field (e.g., "event.type"). Values are compared in their string
+// form. Messages that are not JSON objects do not match.
+func MatchJSONField(field, value string) func(msg Msg) bool {
+	path := strings.Split(field, ".")
+	return func(msg Msg) bool {
+		var v interface{}
+		if err := json.Unmarshal(msg.Val, &v); err != nil {
+			return false
+		}
+
+		for _, name := range path {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			if v, ok = obj[name]; !ok {
+				return false
+			}
+		}
+		return fmt.Sprint(v) == value
+	}
+}
+
+// Run launches the Procs of all the routes and dispatches the messages from
+// the stream to them. Blocks until all the Procs exit. If any of the Procs
+// exits early, the others are cancelled. Returns the first error returned by
+// the Procs.
+func (r *Router) Run(ctx context.Context, stream <-chan Msg) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	routes := r.Routes
+	if r.Default != nil {
+		routes = append(append([]Route(nil), routes...), Route{Name: "default", Proc: r.Default})
+	}
+
+	var firstErr error
+	errOnce := &sync.Once{}
+	dispatched := make(chan struct{})
+
+	wg := &sync.WaitGroup{}
+	chans := make([]chan Msg, len(routes))
+	for i, route := range routes {
+		chans[i] = make(chan Msg, route.Buffer)
+		wg.Add(1)
+		go func(route Route, in <-chan Msg) {
+			defer wg.Done()
+
+			err := route.Proc.Run(ctx, in)
+			if err != nil {
+				errOnce.Do(func() { firstErr = fmt.Errorf("route '%s': %w", route.Name, err) })
+			}
+
+			select {
+			case <-dispatched:
+			default:
+				cancel() // unblock the dispatch if the proc exited early.
+			}
+		}(route, chans[i])
+	}
+
+	r.dispatch(ctx, stream, routes, chans)
+	close(dispatched)
+	for _, ch := range chans {
+		close(ch)
+	}
+	wg.Wait()
+
+	// messages left in the buffers of the procs that exited early.
+	for _, ch := range chans {
+		for msg := range ch {
+			msg.Ack(Retry)
+		}
+	}
+	return firstErr
+}
+
+func (r *Router) dispatch(ctx context.Context, stream <-chan Msg, routes []Route, chans []chan Msg) {
+	metrics := MetricsFrom(ctx)
+
+	for {
+		var msg Msg
+		select {
+		case <-ctx.Done():
+			return
+		case m, open := <-stream:
+			if !open {
+				return
+			}
+			msg = m
+		}
+
+		i := r.route(msg)
+		if i < 0 && r.Default == nil {
+			metrics.Count("fusion_router_messages_total", 1, map[string]string{"route": "none"})
+			msg.Ack(r.NoMatchAck)
+			continue
+		} else if i < 0 {
+			i = len(routes) - 1
+		}
+
+		metrics.Count("fusion_router_messages_total", 1, map[string]string{"route": routes[i].Name})
+		select {
+		case <-ctx.Done():
+			msg.Ack(Retry)
+			return
+		case chans[i] <- msg:
+		}
+	}
+}
+
+// route returns the index of the first route that matches the message or -1.
+func (r *Router) route(msg Msg) int {
+	for i, route := range r.Routes {
+		if route.Match(msg) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Router) init() error {
+	if len(r.Routes) == 0 && r.Default == nil {
+		return errors.New("at least one route or default must be set")
+	}
+
+	for i := range r.Routes {
+		route := &r.Routes[i]
+		if route.Name == "" {
+			route.Name = strconv.Itoa(i)
+		}
+
+		if route.Match == nil {
+			return fmt.Errorf("route '%s': match must be set", route.Name)
+		} else if route.Proc == nil && route.Func == nil {
+			return fmt.Errorf("route '%s': proc or func must be set", route.Name)
+		}
+
+		if route.Proc == nil {
+			route.Proc = &Fn{Workers: route.Workers, Func: route.Func}
+		}
+		if route.Buffer < 0 {
+			route.Buffer = 0
+		}
+	}
+
+	if r.NoMatchAck == nil {
+		r.NoMatchAck = Skip
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package fusion_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/fusion"
+)
+
+func TestRouter_Run(t *testing.T) {
+	t.Parallel()
+
+	// recorder returns a route Func that records the messages it received
+	// by route name and acks them with nil.
+	recorder := func() (func(name string) func(ctx context.Context, msg fusion.Msg) error, func() map[string][]string) {
+		mu := &sync.Mutex{}
+		got := map[string][]string{}
+		fn := func(name string) func(ctx context.Context, msg fusion.Msg) error {
+			return func(ctx context.Context, msg fusion.Msg) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[name] = append(got[name], string(msg.Key))
+				return nil
+			}
+		}
+		return fn, func() map[string][]string {
+			mu.Lock()
+			defer mu.Unlock()
+			return got
+		}
+	}
+
+	t.Run("NoRoutes", func(t *testing.T) {
+		r := &fusion.Router{}
+		assert.Error(t, r.Run(context.Background(), msgStream()))
+
+		r = &fusion.Router{Routes: []fusion.Route{{Name: "a"}}}
+		assert.Error(t, r.Run(context.Background(), msgStream()))
+	})
+
+	t.Run("Routes", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		handle, got := recorder()
+
+		r := &fusion.Router{
+			Routes: []fusion.Route{
+				{Name: "orders", Match: fusion.MatchAttrib("topic", "orders"), Func: handle("orders"), Workers: 2},
+				{Name: "users", Match: fusion.MatchKeyPrefix("user/"), Func: handle("users")},
+				{Name: "clicks", Match: fusion.MatchJSONField("event.type", "click"), Func: handle("clicks"), Buffer: 2},
+			},
+		}
+
+		orders := map[string]string{"topic": "orders"}
+		err := r.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("o1"), Attribs: orders, Ack: ackAs("o1")},
+			fusion.Msg{Key: []byte("user/1"), Ack: ackAs("user/1")},
+			fusion.Msg{Key: []byte("user/2"), Attribs: orders, Ack: ackAs("user/2")},
+			fusion.Msg{Key: []byte("c1"), Val: []byte(`{"event": {"type": "click"}}`), Ack: ackAs("c1")},
+			fusion.Msg{Key: []byte("c2"), Val: []byte(`{"event": {"type": "view"}}`), Ack: ackAs("c2")},
+			fusion.Msg{Key: []byte("x"), Val: []byte(`not json`), Ack: ackAs("x")},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{
+			"orders": {"o1", "user/2"},
+			"users":  {"user/1"},
+			"clicks": {"c1"},
+		}, got())
+		assert.Equal(t, map[string]error{
+			"o1": nil, "user/1": nil, "user/2": nil, "c1": nil,
+			"c2": fusion.Skip, "x": fusion.Skip,
+		}, acks())
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		handle, got := recorder()
+
+		r := &fusion.Router{
+			Routes: []fusion.Route{
+				{Match: fusion.MatchAttrib("topic"), Func: handle("topic")},
+			},
+			Default: &fusion.Fn{Func: handle("default")},
+		}
+
+		err := r.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("a"), Attribs: map[string]string{"topic": "any"}, Ack: ackAs("a")},
+			fusion.Msg{Key: []byte("b"), Ack: ackAs("b")},
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"topic": {"a"}, "default": {"b"}}, got())
+		assert.Equal(t, map[string]error{"a": nil, "b": nil}, acks())
+	})
+
+	t.Run("ProcExitedEarly", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+		handle, _ := recorder()
+
+		r := &fusion.Router{
+			Routes: []fusion.Route{
+				{
+					Name:  "broken",
+					Match: fusion.MatchKeyPrefix("b"),
+					Proc: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+						msg := <-stream
+						msg.Ack(fusion.Retry)
+						return errors.New("failed")
+					}),
+				},
+				{Name: "ok", Match: fusion.MatchKeyPrefix("o"), Func: handle("ok")},
+			},
+			NoMatchAck: fusion.Fail,
+		}
+
+		err := r.Run(context.Background(), msgStream(
+			fusion.Msg{Key: []byte("x"), Ack: ackAs("x")},
+			fusion.Msg{Key: []byte("b1"), Ack: ackAs("b1")},
+		))
+		assert.EqualError(t, err, "route 'broken': failed")
+		assert.Equal(t, map[string]error{"x": fusion.Fail, "b1": fusion.Retry}, acks())
+	})
+}
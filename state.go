@@ -0,0 +1,309 @@
+package fusion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNotFound is returned by State when the key does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrNoStateStore is returned by the State from StateFrom when Runner
+	// has no StateStore configured.
+	ErrNoStateStore = errors.New("state store is not set")
+
+	stateStoreKey   = ctxKey("state_store")
+	stateTxKey      = ctxKey("state_tx")
+	stateBindingKey = ctxKey("state_binding")
+
+	_ StateStore = (*MemState)(nil)
+)
+
+// State provides access to the key-value state of a Proc.
+type State interface {
+	// Get returns the value of the key or ErrNotFound.
+	Get(key string) ([]byte, error)
+
+	// Put sets the value of the key.
+	Put(key string, val []byte) error
+
+	// Delete removes the key. Deleting a non-existent key is not an error.
+	Delete(key string) error
+
+	// Range calls fn for every key with the given prefix in the order of
+	// keys until fn returns false.
+	Range(prefix string, fn func(key string, val []byte) bool) error
+}
+
+// StateStore implementation is the backend for State. Runner makes it
+// available to the Proc through StateFrom.
+type StateStore interface {
+	State
+
+	// Commit should atomically apply all the writes in the batch. A nil
+	// value in the batch denotes deletion of the key.
+	Commit(batch map[string][]byte) error
+
+	// Snapshot should write a consistent copy of the state to w that can
+	// be loaded using Restore.
+	Snapshot(w io.Writer) error
+
+	// Restore should replace the state with the snapshot read from r.
+	Restore(r io.Reader) error
+}
+
+// StateFrom returns the State available in ctx. If the ctx is bound to a
+// message using BindState, writes are buffered and committed only when the
+// message is acked successfully. Otherwise, writes go to the store directly.
+// If Runner has no StateStore, all the operations fail with ErrNoStateStore.
+func StateFrom(ctx context.Context) State {
+	if tx, ok := ctx.Value(stateTxKey).(*stateTx); ok {
+		return tx
+	}
+	if store, ok := ctx.Value(stateStoreKey).(StateStore); ok && store != nil {
+		return store
+	}
+	return noState{}
+}
+
+// BindState begins a state transaction for the message and returns a ctx that
+// carries it. Ack of the message is wrapped so that the writes made through
+// StateFrom(ctx) are committed before the message is acked with nil error.
+// If commit fails, message is nAcked with Retry instead. Writes are discarded
+// if the message is acked with any error (including Skip). Transactions are
+// atomic but not isolated; use Fn.Ordered to serialise messages by key when
+// they share state. Fn binds every message automatically.
+func BindState(ctx context.Context, msg *Msg) context.Context {
+	store, ok := ctx.Value(stateStoreKey).(StateStore)
+	if !ok || store == nil {
+		return ctx
+	}
+
+	binding := &stateBinding{tx: &stateTx{store: store, writes: map[string][]byte{}}}
+	ack, once := msg.Ack, &sync.Once{}
+	msg.Ack = func(err error) {
+		once.Do(func() {
+			if err == nil {
+				if commitErr := binding.current().commit(); commitErr != nil {
+					LogFrom(ctx).Warnf("failed to commit state, will retry: %v", commitErr)
+					err = Retry
+				}
+			}
+			ack(err)
+		})
+	}
+	ctx = context.WithValue(ctx, stateBindingKey, binding)
+	return context.WithValue(ctx, stateTxKey, binding.tx)
+}
+
+// renewState replaces the transaction bound to the message in ctx (if any)
+// with a new one and returns a ctx that carries it. Writes of the previous
+// transaction are discarded, including the ones made after this call by an
+// attempt that is still running (e.g., one that timed out).
+func renewState(ctx context.Context) context.Context {
+	binding, ok := ctx.Value(stateBindingKey).(*stateBinding)
+	if !ok {
+		return ctx
+	}
+
+	binding.mu.Lock()
+	tx := &stateTx{store: binding.tx.store, writes: map[string][]byte{}}
+	binding.tx = tx
+	binding.mu.Unlock()
+	return context.WithValue(ctx, stateTxKey, tx)
+}
+
+func withStateStore(ctx context.Context, store StateStore) context.Context {
+	return context.WithValue(ctx, stateStoreKey, store)
+}
+
+// MemState implements an in-memory StateStore. State can be persisted across
+// restarts using Snapshot and Restore.
+type MemState struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// Get returns the value of the key or ErrNotFound.
+func (ms *MemState) Get(key string) ([]byte, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	val, found := ms.data[key]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, val...), nil
+}
+
+// Put sets the value of the key.
+func (ms *MemState) Put(key string, val []byte) error {
+	return ms.Commit(map[string][]byte{key: nonNil(val)})
+}
+
+// Delete removes the key.
+func (ms *MemState) Delete(key string) error {
+	return ms.Commit(map[string][]byte{key: nil})
+}
+
+// Range calls fn for every key with the prefix in the order of keys. fn is
+// called with a consistent view of the state and must not modify it.
+func (ms *MemState) Range(prefix string, fn func(key string, val []byte) bool) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	rangeSorted(ms.data, prefix, fn)
+	return nil
+}
+
+// Commit applies all the writes in the batch atomically.
+func (ms *MemState) Commit(batch map[string][]byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data = applyBatch(ms.data, batch)
+	return nil
+}
+
+// Snapshot writes the state as JSON to w.
+func (ms *MemState) Snapshot(w io.Writer) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return json.NewEncoder(w).Encode(ms.data)
+}
+
+// Restore replaces the state with the snapshot read from r.
+func (ms *MemState) Restore(r io.Reader) error {
+	data := map[string][]byte{}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data = data
+	return nil
+}
+
+// stateTx buffers the writes made while processing a message.
+type stateTx struct {
+	store  StateStore
+	mu     sync.Mutex
+	writes map[string][]byte // nil value denotes deletion.
+}
+
+func (tx *stateTx) Get(key string) ([]byte, error) {
+	tx.mu.Lock()
+	val, found := tx.writes[key]
+	tx.mu.Unlock()
+
+	if !found {
+		return tx.store.Get(key)
+	} else if val == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, val...), nil
+}
+
+func (tx *stateTx) Put(key string, val []byte) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.writes[key] = append([]byte{}, val...)
+	return nil
+}
+
+func (tx *stateTx) Delete(key string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.writes[key] = nil
+	return nil
+}
+
+func (tx *stateTx) Range(prefix string, fn func(key string, val []byte) bool) error {
+	view := map[string][]byte{}
+	err := tx.store.Range(prefix, func(key string, val []byte) bool {
+		view[key] = append([]byte{}, val...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	tx.mu.Lock()
+	view = applyBatch(view, tx.writes)
+	tx.mu.Unlock()
+
+	rangeSorted(view, prefix, fn)
+	return nil
+}
+
+func (tx *stateTx) commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	return tx.store.Commit(tx.writes)
+}
+
+// stateBinding tracks the transaction of the current attempt of a message.
+type stateBinding struct {
+	mu sync.Mutex
+	tx *stateTx
+}
+
+func (sb *stateBinding) current() *stateTx {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.tx
+}
+
+type noState struct{}
+
+func (noState) Get(_ string) ([]byte, error)                      { return nil, ErrNoStateStore }
+func (noState) Put(_ string, _ []byte) error                      { return ErrNoStateStore }
+func (noState) Delete(_ string) error                             { return ErrNoStateStore }
+func (noState) Range(_ string, _ func(string, []byte) bool) error { return ErrNoStateStore }
+
+// applyBatch applies the writes in the batch to data and returns it.
+func applyBatch(data, batch map[string][]byte) map[string][]byte {
+	if data == nil {
+		data = map[string][]byte{}
+	}
+	for key, val := range batch {
+		if val == nil {
+			delete(data, key)
+		} else {
+			data[key] = append([]byte{}, val...)
+		}
+	}
+	return data
+}
+
+func rangeSorted(data map[string][]byte, prefix string, fn func(key string, val []byte) bool) {
+	var keys []string
+	for key := range data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !fn(key, data[key]) {
+			return
+		}
+	}
+}
+
+func nonNil(val []byte) []byte {
+	if val == nil {
+		return []byte{}
+	}
+	return val
+}
@@ -0,0 +1,258 @@
+package fusion_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestMemState(t *testing.T) {
+	t.Parallel()
+
+	ms := &fusion.MemState{}
+	testStateStore(t, ms)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, ms.Snapshot(buf))
+
+	restored := &fusion.MemState{}
+	require.NoError(t, restored.Restore(buf))
+	assert.Equal(t, rangeAll(t, ms, ""), rangeAll(t, restored, ""))
+}
+
+func TestFileState(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("Reopen", func(t *testing.T) {
+		path := filepath.Join(dir, "reopen.log")
+
+		fs, err := fusion.OpenFileState(path)
+		require.NoError(t, err)
+		testStateStore(t, fs)
+		want := rangeAll(t, fs, "")
+		require.NoError(t, fs.Close())
+		assert.Equal(t, os.ErrClosed, fs.Put("k", nil))
+
+		fs, err = fusion.OpenFileState(path)
+		require.NoError(t, err)
+		defer fs.Close()
+		assert.Equal(t, want, rangeAll(t, fs, ""))
+	})
+
+	t.Run("PartialCommit", func(t *testing.T) {
+		path := filepath.Join(dir, "partial.log")
+
+		fs, err := fusion.OpenFileState(path)
+		require.NoError(t, err)
+		require.NoError(t, fs.Put("a", []byte("1")))
+		require.NoError(t, fs.Close())
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"writes":{"b":"`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		fs, err = fusion.OpenFileState(path)
+		require.NoError(t, err)
+		defer fs.Close()
+		assert.Equal(t, map[string]string{"a": "1"}, rangeAll(t, fs, ""))
+
+		require.NoError(t, fs.Put("c", []byte("3")))
+		assert.Equal(t, map[string]string{"a": "1", "c": "3"}, rangeAll(t, fs, ""))
+	})
+
+	t.Run("Compaction", func(t *testing.T) {
+		path := filepath.Join(dir, "compact.log")
+
+		fs, err := fusion.OpenFileState(path)
+		require.NoError(t, err)
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, fs.Put("counter", []byte(strconv.Itoa(i))))
+		}
+		require.NoError(t, fs.Close())
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.True(t, info.Size() < 64*1024, "log must be compacted")
+
+		fs, err = fusion.OpenFileState(path)
+		require.NoError(t, err)
+		defer fs.Close()
+		assert.Equal(t, map[string]string{"counter": "1999"}, rangeAll(t, fs, ""))
+	})
+
+	t.Run("EmptyValue", func(t *testing.T) {
+		path := filepath.Join(dir, "empty.log")
+
+		fs, err := fusion.OpenFileState(path)
+		require.NoError(t, err)
+		require.NoError(t, fs.Put("empty", []byte{}))
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, fs.Put("counter", []byte(strconv.Itoa(i))))
+		}
+		require.NoError(t, fs.Close())
+
+		fs, err = fusion.OpenFileState(path)
+		require.NoError(t, err)
+		defer fs.Close()
+		val, err := fs.Get("empty")
+		require.NoError(t, err)
+		assert.Empty(t, val)
+		assert.Equal(t, map[string]string{"counter": "1999", "empty": ""}, rangeAll(t, fs, ""))
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		ms := &fusion.MemState{}
+		require.NoError(t, ms.Put("x", []byte("10")))
+		buf := &bytes.Buffer{}
+		require.NoError(t, ms.Snapshot(buf))
+
+		path := filepath.Join(dir, "restore.log")
+		fs, err := fusion.OpenFileState(path)
+		require.NoError(t, err)
+		require.NoError(t, fs.Put("y", []byte("20")))
+		require.NoError(t, fs.Restore(buf))
+		require.NoError(t, fs.Close())
+
+		fs, err = fusion.OpenFileState(path)
+		require.NoError(t, err)
+		defer fs.Close()
+		assert.Equal(t, map[string]string{"x": "10"}, rangeAll(t, fs, ""))
+	})
+}
+
+func TestFn_Run_State(t *testing.T) {
+	t.Parallel()
+
+	t.Run("CommitOnAck", func(t *testing.T) {
+		store := &fusion.MemState{}
+		ackAs, acks := ackRecorder()
+
+		messages := []fusion.Msg{
+			{Key: []byte("a"), Ack: ackAs("1")},
+			{Key: []byte("a"), Val: []byte("retry"), Ack: ackAs("2")},
+			{Key: []byte("b"), Ack: ackAs("3")},
+			{Key: []byte("a"), Ack: ackAs("4")},
+		}
+
+		runner := fusion.Runner{
+			State:  store,
+			Stream: sliceStream(messages),
+			Proc: &fusion.Fn{
+				Workers: 1,
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					state := fusion.StateFrom(ctx)
+
+					count := 0
+					if val, err := state.Get(string(msg.Key)); err == nil {
+						count, _ = strconv.Atoi(string(val))
+					} else if err != fusion.ErrNotFound {
+						return err
+					}
+
+					if err := state.Put(string(msg.Key), []byte(strconv.Itoa(count+1))); err != nil {
+						return err
+					}
+
+					// the write must be visible within the transaction.
+					val, err := state.Get(string(msg.Key))
+					require.NoError(t, err)
+					assert.Equal(t, strconv.Itoa(count+1), string(val))
+
+					if string(msg.Val) == "retry" {
+						return fusion.Retry
+					}
+					return nil
+				},
+			},
+		}
+		require.NoError(t, runner.Run(context.Background()))
+
+		assert.Equal(t, map[string]error{"1": nil, "2": fusion.Retry, "3": nil, "4": nil}, acks())
+		assert.Equal(t, map[string]string{"a": "2", "b": "1"}, rangeAll(t, store, ""))
+	})
+
+	t.Run("NoStore", func(t *testing.T) {
+		ackAs, acks := ackRecorder()
+
+		runner := fusion.Runner{
+			Stream: sliceStream([]fusion.Msg{{Ack: ackAs("1")}}),
+			Proc: &fusion.Fn{
+				Workers: 1,
+				Func: func(ctx context.Context, msg fusion.Msg) error {
+					if err := fusion.StateFrom(ctx).Put("k", nil); err != fusion.ErrNoStateStore {
+						return fusion.Fail
+					}
+					return nil
+				},
+			},
+		}
+		require.NoError(t, runner.Run(context.Background()))
+		assert.Equal(t, map[string]error{"1": nil}, acks())
+	})
+}
+
+func testStateStore(t *testing.T, store fusion.StateStore) {
+	require.NoError(t, store.Put("user/1", []byte("alice")))
+	require.NoError(t, store.Put("user/2", []byte("bob")))
+	require.NoError(t, store.Put("user/3", nil))
+	require.NoError(t, store.Put("order/1", []byte("book")))
+	require.NoError(t, store.Delete("user/2"))
+	require.NoError(t, store.Delete("missing"))
+
+	val, err := store.Get("user/1")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", string(val))
+
+	_, err = store.Get("user/2")
+	assert.Equal(t, fusion.ErrNotFound, err)
+
+	require.NoError(t, store.Commit(map[string][]byte{
+		"user/4":  []byte("dave"),
+		"order/1": nil,
+	}))
+	assert.Equal(t, map[string]string{"user/1": "alice", "user/3": "", "user/4": "dave"}, rangeAll(t, store, "user/"))
+	assert.Empty(t, rangeAll(t, store, "order/"))
+
+	var keys []string
+	require.NoError(t, store.Range("", func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	}))
+	assert.Equal(t, []string{"user/1", "user/3"}, keys)
+}
+
+func rangeAll(t *testing.T, state fusion.State, prefix string) map[string]string {
+	res := map[string]string{}
+	require.NoError(t, state.Range(prefix, func(key string, val []byte) bool {
+		res[key] = string(val)
+		return true
+	}))
+	return res
+}
+
+// sliceStream returns a Stream that emits the messages and then ends.
+func sliceStream(messages []fusion.Msg) fusion.Stream {
+	i := 0
+	return fusion.StreamFn(func(ctx context.Context) (*fusion.Msg, error) {
+		if i >= len(messages) {
+			return nil, context.Canceled
+		}
+		i++
+		return &messages[i-1], nil
+	})
+}
@@ -20,6 +20,13 @@ type Stream interface {
 	Out(ctx context.Context) (<-chan Msg, error)
 }
 
+// Flusher can be implemented by a Stream that needs to finalise (e.g., commit
+// the offsets of acknowledged messages) during shutdown. Runner invokes Flush
+// once the Proc has exited and the in-flight messages are acknowledged.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
 // StreamFn implements a source using a Go function value.
 type StreamFn func(ctx context.Context) (*Msg, error)
 
@@ -0,0 +1,225 @@
+package fusion
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errStreamClosed is the failure of a Stream that closes while ctx is still
+// active when Supervisor.ReopenOnClose is set.
+var errStreamClosed = errors.New("stream closed unexpectedly")
+
+// Backoff represents the delay policy for restarts. Implementations from the
+// retry package (e.g., retry.ExpBackoff) satisfy this interface.
+type Backoff interface {
+	// RetryAfter should return the time duration to wait before the given
+	// attempt.
+	RetryAfter(attempts int) time.Duration
+}
+
+// Supervisor configures the restart behaviour of Runner. If the Stream fails
+// to start (or closes while running when ReopenOnClose is set) or the Proc
+// exits with an error, it is restarted after a backoff as long as the number
+// of restarts within the Window does not exceed MaxRestarts. Restarts are
+// counted together for Stream and Proc.
+type Supervisor struct {
+	// Backoff decides the delay before a restart based on the number of
+	// restarts within the current window. Defaults to 1s constant delay.
+	Backoff Backoff
+
+	// MaxRestarts is the maximum number of restarts allowed within Window
+	// after which Runner gives up and returns the error. Defaults to 5 per
+	// 1 minute.
+	MaxRestarts int
+	Window      time.Duration
+
+	// ReopenOnClose treats the Stream closing its channel while ctx is still
+	// active as a failure and reopens it. Set this for streams that are not
+	// expected to end (e.g., Kafka). Leave it unset for finite streams such
+	// as a LineStream reading a file.
+	ReopenOnClose bool
+
+	mu        sync.Mutex
+	restarts  []time.Time
+	streamErr error
+}
+
+// restart checks the restart budget for the failed component and waits for
+// the backoff. Returns false if the budget is exhausted or ctx is cancelled
+// while waiting, in which case the component must not be restarted.
+func (sv *Supervisor) restart(ctx context.Context, fu *Runner, component string, err error) bool {
+	attempts, ok := sv.allow(time.Now())
+	if !ok {
+		fu.Log.Errorf("%s failed, restart budget exhausted (%d in %s): %v",
+			component, sv.MaxRestarts, sv.Window, err)
+		return false
+	}
+
+	delay := sv.Backoff.RetryAfter(attempts)
+	fu.Log.With(map[string]interface{}{
+		"component": component,
+		"attempt":   attempts,
+	}).Warnf("%s failed, restarting in %s: %v", component, delay, err)
+	fu.Metrics.Count("fusion_runner_restarts_total", 1, map[string]string{"component": component})
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// allow records a restart at t if it fits in the budget and returns the
+// number of restarts within the current window including this one.
+func (sv *Supervisor) allow(t time.Time) (int, bool) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	recent := sv.restarts[:0]
+	for _, at := range sv.restarts {
+		if t.Sub(at) < sv.Window {
+			recent = append(recent, at)
+		}
+	}
+	sv.restarts = recent
+
+	if len(sv.restarts) >= sv.MaxRestarts {
+		return len(sv.restarts), false
+	}
+	sv.restarts = append(sv.restarts, t)
+	return len(sv.restarts), true
+}
+
+// fail records the error of a Stream that could not be reopened.
+func (sv *Supervisor) fail(err error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.streamErr = err
+}
+
+// err returns the error recorded by fail, if any.
+func (sv *Supervisor) err() error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.streamErr
+}
+
+func (sv *Supervisor) init() {
+	if sv.Backoff == nil {
+		sv.Backoff = constBackoff(1 * time.Second)
+	}
+	if sv.MaxRestarts <= 0 {
+		sv.MaxRestarts = 5
+	}
+	if sv.Window <= 0 {
+		sv.Window = 1 * time.Minute
+	}
+	sv.fail(nil)
+}
+
+// openStream starts the Stream, restarting it under supervision if it fails
+// (or panics) while starting. With ReopenOnClose, the returned channel is fed
+// from the Stream across reopens and is closed only when ctx is cancelled or
+// the restart budget is exhausted, in which case the failure is recorded on
+// the Supervisor.
+func (fu *Runner) openStream(ctx context.Context) (<-chan Msg, error) {
+	if fu.Supervise == nil {
+		return fu.Stream.Out(ctx)
+	}
+
+	streamCh, err := fu.startStream(ctx)
+	if err != nil || streamCh == nil || !fu.Supervise.ReopenOnClose {
+		return streamCh, err
+	}
+
+	out := make(chan Msg)
+	go func() {
+		defer close(out)
+
+		for {
+			// the consumer drains the channel until it is closed, so the
+			// messages can be forwarded without watching ctx.
+			for msg := range streamCh {
+				out <- msg
+			}
+
+			if ctx.Err() != nil {
+				return
+			} else if !fu.Supervise.restart(ctx, fu, "stream", errStreamClosed) {
+				if ctx.Err() == nil {
+					fu.Supervise.fail(errStreamClosed)
+				}
+				return
+			}
+
+			streamCh, err = fu.startStream(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					fu.Supervise.fail(err)
+				}
+				return
+			} else if streamCh == nil {
+				streamCh = closedStream()
+			}
+		}
+	}()
+	return out, nil
+}
+
+// startStream calls Out of the Stream, retrying within the restart budget if
+// it fails.
+func (fu *Runner) startStream(ctx context.Context) (<-chan Msg, error) {
+	for {
+		streamCh, err := safeOut(ctx, fu.Stream)
+		if err == nil || !fu.Supervise.restart(ctx, fu, "stream", err) {
+			return streamCh, err
+		}
+	}
+}
+
+// runProc runs the Proc, restarting it under supervision if it exits with
+// an error (or panics) while ctx is still active. Restarted Proc continues
+// consuming from the same stream.
+func (fu *Runner) runProc(ctx context.Context, stream <-chan Msg) error {
+	if fu.Supervise == nil {
+		return fu.Proc.Run(ctx, stream)
+	}
+
+	for {
+		err := safeRun(ctx, fu.Proc, stream)
+		if err == nil || ctx.Err() != nil || !fu.Supervise.restart(ctx, fu, "proc", err) {
+			return err
+		}
+	}
+}
+
+func safeOut(ctx context.Context, stream Stream) (ch <-chan Msg, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = recovered(v)
+		}
+	}()
+	return stream.Out(ctx)
+}
+
+func safeRun(ctx context.Context, proc Proc, stream <-chan Msg) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = recovered(v)
+		}
+	}()
+	return proc.Run(ctx, stream)
+}
+
+func closedStream() <-chan Msg {
+	ch := make(chan Msg)
+	close(ch)
+	return ch
+}
+
+type constBackoff time.Duration
+
+func (cb constBackoff) RetryAfter(_ int) time.Duration { return time.Duration(cb) }
@@ -0,0 +1,167 @@
+package fusion_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/retry"
+)
+
+func TestRunner_Run_Supervise(t *testing.T) {
+	t.Parallel()
+
+	t.Run("RestartProc", func(t *testing.T) {
+		pm := &fusion.PromMetrics{}
+		calls := 0
+		consumed := 0
+		fu := fusion.Runner{
+			Metrics: pm,
+			Stream:  &fusion.LineStream{From: strings.NewReader("a\nb\n")},
+			Supervise: &fusion.Supervisor{
+				Backoff: retry.ConstBackoff(time.Millisecond),
+			},
+			Proc: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+				calls++
+				if calls == 1 {
+					panic("crashed")
+				} else if calls == 2 {
+					return errors.New("failed")
+				}
+
+				for msg := range stream {
+					consumed++
+					msg.Ack(nil)
+				}
+				return nil
+			}),
+		}
+		require.NoError(t, fu.Run(context.Background()))
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, 2, consumed)
+
+		out := &strings.Builder{}
+		require.NoError(t, pm.Write(out))
+		assert.Contains(t, out.String(), `fusion_runner_restarts_total{component="proc"} 2`)
+	})
+
+	t.Run("RestartStream", func(t *testing.T) {
+		calls := 0
+		fu := fusion.Runner{
+			Stream: &flakyStream{
+				Stream:   &fusion.LineStream{From: strings.NewReader("a\n")},
+				calls:    &calls,
+				failures: 2,
+			},
+			Supervise: &fusion.Supervisor{
+				Backoff: retry.ConstBackoff(time.Millisecond),
+			},
+		}
+		require.NoError(t, fu.Run(context.Background()))
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("BudgetExhausted", func(t *testing.T) {
+		calls := 0
+		fu := fusion.Runner{
+			Stream: &fusion.LineStream{From: strings.NewReader("a\n")},
+			Supervise: &fusion.Supervisor{
+				Backoff:     retry.ConstBackoff(time.Millisecond),
+				MaxRestarts: 2,
+				Window:      time.Minute,
+			},
+			Proc: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+				calls++
+				return errors.New("failed")
+			}),
+		}
+		assert.EqualError(t, fu.Run(context.Background()), "failed")
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("ReopenOnClose", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stream := &closingStream{closes: 2}
+		var got []string
+		fu := fusion.Runner{
+			Stream: stream,
+			Supervise: &fusion.Supervisor{
+				Backoff:       retry.ConstBackoff(time.Millisecond),
+				ReopenOnClose: true,
+			},
+			Proc: fusion.ProcFn(func(ctx context.Context, stream <-chan fusion.Msg) error {
+				for msg := range stream {
+					got = append(got, string(msg.Key))
+					msg.Ack(nil)
+					if len(got) == 3 {
+						cancel()
+					}
+				}
+				return nil
+			}),
+		}
+		require.NoError(t, fu.Run(ctx))
+		assert.Equal(t, []string{"1", "2", "3"}, got)
+		assert.Equal(t, 3, stream.opens)
+	})
+
+	t.Run("ReopenBudgetExhausted", func(t *testing.T) {
+		stream := &closingStream{closes: 10}
+		fu := fusion.Runner{
+			Stream: stream,
+			Supervise: &fusion.Supervisor{
+				Backoff:       retry.ConstBackoff(time.Millisecond),
+				MaxRestarts:   2,
+				ReopenOnClose: true,
+			},
+		}
+		assert.EqualError(t, fu.Run(context.Background()), "stream closed unexpectedly")
+		assert.Equal(t, 3, stream.opens)
+	})
+}
+
+// closingStream emits one message on each Out and closes the channel right
+// after for the first closes calls. Later channels stay open until ctx is
+// cancelled.
+type closingStream struct {
+	opens  int
+	closes int
+}
+
+func (cs *closingStream) Out(ctx context.Context) (<-chan fusion.Msg, error) {
+	cs.opens++
+	ch := make(chan fusion.Msg, 1)
+	ch <- fusion.Msg{Key: []byte(strconv.Itoa(cs.opens)), Ack: func(_ error) {}}
+	if cs.opens <= cs.closes {
+		close(ch)
+	} else {
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+	}
+	return ch, nil
+}
+
+type flakyStream struct {
+	fusion.Stream
+	calls    *int
+	failures int
+}
+
+func (fs *flakyStream) Out(ctx context.Context) (<-chan fusion.Msg, error) {
+	*fs.calls++
+	if *fs.calls <= fs.failures {
+		return nil, errors.New("connection refused")
+	}
+	return fs.Stream.Out(ctx)
+}
@@ -0,0 +1,226 @@
+package fusion
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentAttrib is the message attribute used for propagating the trace
+// context in W3C traceparent format.
+const TraceParentAttrib = "traceparent"
+
+var (
+	tracerKey = ctxKey("tracer")
+	spanKey   = ctxKey("span")
+
+	_ Tracer = (*MemTracer)(nil)
+)
+
+// Tracer implementation creates spans for the stages a message goes through.
+type Tracer interface {
+	// Start should start a new span with given name as a child of parent.
+	// If parent is not valid, a new trace should be started.
+	Start(name string, parent SpanContext) Span
+}
+
+// Span represents a single unit of work in a trace.
+type Span interface {
+	// Context returns the span context to be propagated to child spans.
+	Context() SpanContext
+
+	// End should record the end of the span with the outcome. err is the
+	// error the message was acked with.
+	End(err error)
+}
+
+// SpanContext identifies a span as per the W3C trace context spec.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// ParseTraceParent parses the W3C traceparent header value.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("invalid traceparent '%s'", s)
+	}
+
+	var flags [1]byte
+	fields := []struct {
+		dst []byte
+		src string
+	}{
+		{dst: sc.TraceID[:], src: parts[1]},
+		{dst: sc.SpanID[:], src: parts[2]},
+		{dst: flags[:], src: parts[3]},
+	}
+	for _, f := range fields {
+		if len(f.src) != 2*len(f.dst) {
+			return sc, fmt.Errorf("invalid traceparent '%s'", s)
+		} else if _, err := hex.Decode(f.dst, []byte(f.src)); err != nil {
+			return sc, fmt.Errorf("invalid traceparent '%s': %w", s, err)
+		}
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return sc, errors.New("traceparent has zero trace-id or span-id")
+	}
+	return sc, nil
+}
+
+// IsValid returns true if both trace-id and span-id are non-zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// String returns the span context in W3C traceparent format.
+func (sc SpanContext) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x",
+		hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// ExtractTrace returns the span context from the message attributes. Returns
+// zero value if the message has no valid trace context.
+func ExtractTrace(msg Msg) SpanContext {
+	sc, _ := ParseTraceParent(msg.Attribs[TraceParentAttrib])
+	return sc
+}
+
+// InjectTrace sets the span context of the current span in ctx (if any) to
+// the message attributes so that downstream stages continue the trace.
+func InjectTrace(ctx context.Context, msg *Msg) {
+	sc := SpanFrom(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	msg.Attribs = withAttrib(msg.Attribs, TraceParentAttrib, sc.String())
+}
+
+// TracerFrom extracts the tracer set by fusion Runner from the context.
+// Returns a no-op tracer if not set.
+func TracerFrom(ctx context.Context) Tracer {
+	tracer, ok := ctx.Value(tracerKey).(Tracer)
+	if !ok || tracer == nil {
+		return noOpTracer{}
+	}
+	return tracer
+}
+
+// SpanFrom returns the context of the current span in ctx.
+func SpanFrom(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanKey).(SpanContext)
+	return sc
+}
+
+// WithSpan returns a ctx with the given span context set as current span.
+func WithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey, sc)
+}
+
+func withTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey, tracer)
+}
+
+// startSpan starts a span for the message using the tracer in ctx. Returns
+// nil span if no tracer is set.
+func startSpan(ctx context.Context, name string, msg Msg) (context.Context, Span) {
+	tracer, ok := ctx.Value(tracerKey).(Tracer)
+	if !ok || tracer == nil {
+		return ctx, nil
+	}
+	span := tracer.Start(name, ExtractTrace(msg))
+	return WithSpan(ctx, span.Context()), span
+}
+
+// withAttrib returns a copy of attribs with the key set to val. Attribs map
+// of a message may be shared with other messages and must not be mutated.
+func withAttrib(attribs map[string]string, key, val string) map[string]string {
+	res := make(map[string]string, len(attribs)+1)
+	for k, v := range attribs {
+		res[k] = v
+	}
+	res[key] = val
+	return res
+}
+
+// MemTracer implements a Tracer that records all the finished spans in
+// memory. Useful for tests.
+type MemTracer struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// RecordedSpan is a finished span recorded by MemTracer.
+type RecordedSpan struct {
+	Name    string
+	Context SpanContext
+	Parent  SpanContext
+	Start   time.Time
+	End     time.Time
+	Err     error
+}
+
+// Start starts a new span.
+func (mt *MemTracer) Start(name string, parent SpanContext) Span {
+	sc := SpanContext{TraceID: parent.TraceID, Flags: parent.Flags}
+	if !parent.IsValid() {
+		_, _ = rand.Read(sc.TraceID[:])
+		sc.Flags = 1 // sampled.
+	}
+	_, _ = rand.Read(sc.SpanID[:])
+
+	return &memSpan{
+		tracer: mt,
+		rec: RecordedSpan{
+			Name:    name,
+			Context: sc,
+			Parent:  parent,
+			Start:   time.Now(),
+		},
+	}
+}
+
+// Spans returns all the spans finished so far.
+func (mt *MemTracer) Spans() []RecordedSpan {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return append([]RecordedSpan(nil), mt.spans...)
+}
+
+type memSpan struct {
+	tracer *MemTracer
+	once   sync.Once
+	rec    RecordedSpan
+}
+
+func (ms *memSpan) Context() SpanContext { return ms.rec.Context }
+
+func (ms *memSpan) End(err error) {
+	ms.once.Do(func() {
+		ms.rec.End = time.Now()
+		ms.rec.Err = err
+
+		ms.tracer.mu.Lock()
+		defer ms.tracer.mu.Unlock()
+		ms.tracer.spans = append(ms.tracer.spans, ms.rec)
+	})
+}
+
+type noOpTracer struct{}
+
+func (noOpTracer) Start(_ string, parent SpanContext) Span { return noOpSpan{sc: parent} }
+
+type noOpSpan struct{ sc SpanContext }
+
+func (ns noOpSpan) Context() SpanContext { return ns.sc }
+func (noOpSpan) End(_ error)             {}
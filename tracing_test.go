@@ -0,0 +1,80 @@
+package fusion_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	t.Parallel()
+
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, err := fusion.ParseTraceParent(valid)
+	require.NoError(t, err)
+	assert.True(t, sc.IsValid())
+	assert.Equal(t, byte(1), sc.Flags)
+	assert.Equal(t, valid, sc.String())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01",
+	} {
+		_, err := fusion.ParseTraceParent(invalid)
+		assert.Error(t, err, "traceparent '%s' must be invalid", invalid)
+	}
+}
+
+func TestRunner_Run_Tracing(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tracer := &fusion.MemTracer{}
+	var emitted fusion.Msg
+	fu := fusion.Runner{
+		Tracer: tracer,
+		Stream: fusion.StreamFn(func() func(ctx context.Context) (*fusion.Msg, error) {
+			sent := false
+			return func(ctx context.Context) (*fusion.Msg, error) {
+				if sent {
+					return nil, context.Canceled
+				}
+				sent = true
+				return &fusion.Msg{
+					Attribs: map[string]string{fusion.TraceParentAttrib: parent},
+					Ack:     func(_ error) {},
+				}, nil
+			}
+		}()),
+		Proc: &fusion.Fn{
+			Func: func(ctx context.Context, msg fusion.Msg) error {
+				fusion.InjectTrace(ctx, &emitted)
+				return fusion.Retry
+			},
+		},
+	}
+	require.NoError(t, fu.Run(context.Background()))
+
+	spans := tracer.Spans()
+	require.Len(t, spans, 2)
+	fnSpan, runnerSpan := spans[0], spans[1]
+
+	assert.Equal(t, "fusion.runner", runnerSpan.Name)
+	assert.Equal(t, parent, runnerSpan.Parent.String())
+	assert.Equal(t, runnerSpan.Parent.TraceID, runnerSpan.Context.TraceID)
+	assert.Equal(t, fusion.Retry, runnerSpan.Err)
+
+	assert.Equal(t, "fusion.fn", fnSpan.Name)
+	assert.Equal(t, runnerSpan.Context, fnSpan.Parent)
+	assert.Equal(t, fusion.Retry, fnSpan.Err)
+
+	assert.Equal(t, fnSpan.Context, fusion.ExtractTrace(emitted))
+}
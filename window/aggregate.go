@@ -0,0 +1,371 @@
+package window
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spy16/fusion"
+)
+
+var _ fusion.Proc = (*Aggregate)(nil)
+
+// Result is the aggregate of a window for a key.
+type Result struct {
+	Key    string      `json:"key"`
+	Window Span        `json:"window"`
+	Value  interface{} `json:"value"`
+	Count  int         `json:"count"`
+
+	// Update is true if the window was emitted before and this result
+	// includes the messages that arrived late.
+	Update bool `json:"update"`
+}
+
+// Aggregate implements a fusion Proc that groups messages by key into windows
+// and emits the aggregate of each window as a message to the Sink once the
+// window closes. A window closes when the watermark passes its end. With
+// processing time, watermark is the current time. With event time, watermark
+// is the highest event time seen minus MaxOutOfOrder. All the open windows
+// are closed when the stream ends.
+//
+// Messages are acked once the results of all the windows they belong to are
+// acked by the Sink. Hence, messages stay in-flight while their windows are
+// open.
+type Aggregate struct {
+	// Windows assigns the windows to messages. Use Tumbling, Hopping or
+	// Session.
+	Windows Assigner
+
+	// KeyFunc returns the key to group messages by. Defaults to Msg.Key.
+	KeyFunc func(msg fusion.Msg) string
+
+	// EventTime can be set to extract the event time of the messages (e.g.,
+	// using AttribTime or by decoding Msg.Val). If not set, the time at
+	// which the message is received is used. Messages for which EventTime
+	// returns error are acked with Fail.
+	EventTime func(msg fusion.Msg) (time.Time, error)
+
+	// MaxOutOfOrder is the duration by which the watermark trails the
+	// highest event time seen. Windows close only after this delay to let
+	// the out-of-order messages in.
+	MaxOutOfOrder time.Duration
+
+	// AllowedLateness is the duration for which a window is retained after
+	// it closes. Messages arriving late within this duration update the
+	// window and an updated result is emitted. Messages later than that are
+	// acked with LateAck, which defaults to Skip.
+	AllowedLateness time.Duration
+	LateAck         error
+
+	// Init, Add and Merge define the aggregation. Init returns the initial
+	// accumulator of a window, Add folds a message into an accumulator and
+	// Merge combines two accumulators when session windows merge. If none
+	// are set, the number of messages in the window is the aggregate.
+	Init  func() interface{}
+	Add   func(acc interface{}, msg fusion.Msg) interface{}
+	Merge func(a, b interface{}) interface{}
+
+	// Encode returns the value of the result message. Defaults to JSON of
+	// the Result.Value.
+	Encode func(res Result) ([]byte, error)
+
+	// Sink is the Proc that consumes the result messages. Results carry the
+	// key as Msg.Key and window details as attributes. If not set, results
+	// are acked with nil error.
+	Sink fusion.Proc
+
+	// TickInterval is the interval at which windows are checked for closing
+	// when no messages arrive. Defaults to 1s.
+	TickInterval time.Duration
+
+	log       fusion.Log
+	metrics   fusion.Metrics
+	merging   bool
+	watermark time.Time
+	maxEvent  time.Time
+	windows   map[string][]*window
+}
+
+type window struct {
+	key     string
+	span    Span
+	acc     interface{}
+	count   int
+	emitted bool
+
+	// acks of the messages added since the last emission.
+	acks []func(err error)
+}
+
+// Run consumes the stream and runs the Sink with the results. Blocks until
+// the stream is closed (after emitting all the windows) or the Sink exits.
+// Returns the error returned by the Sink.
+func (agg *Aggregate) Run(ctx context.Context, stream <-chan fusion.Msg) error {
+	if err := agg.init(ctx); err != nil {
+		return err
+	}
+
+	sink := agg.Sink
+	if sink == nil {
+		sink = fusion.ProcFn(func(_ context.Context, results <-chan fusion.Msg) error {
+			for res := range results {
+				res.Ack(nil)
+			}
+			return nil
+		})
+	}
+
+	return fusion.Feed(ctx, sink, func(ctx context.Context, out chan<- fusion.Msg) {
+		agg.aggregate(ctx, stream, out)
+	})
+}
+
+func (agg *Aggregate) aggregate(ctx context.Context, stream <-chan fusion.Msg, out chan<- fusion.Msg) {
+	ticker := time.NewTicker(agg.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			agg.abandon()
+			return
+
+		case <-ticker.C:
+			if agg.EventTime == nil {
+				agg.watermark = time.Now()
+			}
+
+		case msg, open := <-stream:
+			if !open {
+				agg.watermark = time.Unix(0, math.MaxInt64)
+				agg.fire(ctx, out)
+				return
+			}
+			agg.add(msg)
+		}
+		agg.fire(ctx, out)
+	}
+}
+
+// add adds the message to all the windows it belongs to.
+func (agg *Aggregate) add(msg fusion.Msg) {
+	t := time.Now()
+	if agg.EventTime == nil {
+		agg.watermark = t
+	} else {
+		var err error
+		if t, err = agg.EventTime(msg); err != nil {
+			agg.log.Warnf("failed to extract event time, failing message: %v", err)
+			msg.Ack(fusion.Fail)
+			return
+		}
+
+		if t.After(agg.maxEvent) {
+			agg.maxEvent = t
+			if wm := t.Add(-agg.MaxOutOfOrder); wm.After(agg.watermark) {
+				agg.watermark = wm
+			}
+		}
+	}
+
+	var spans []Span
+	for _, span := range agg.Windows.Assign(t.Round(0)) {
+		if !agg.expired(span) {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) == 0 {
+		agg.metrics.Count("fusion_window_late_total", 1, nil)
+		msg.Ack(agg.LateAck)
+		return
+	}
+
+	key := agg.KeyFunc(msg)
+	group := fusion.NewAckGroup(msg)
+	for _, span := range spans {
+		w := agg.window(key, span)
+		w.acc = agg.Add(w.acc, msg)
+		w.count++
+		w.acks = append(w.acks, group.Add(fusion.Msg{}).Ack)
+	}
+	group.Seal(nil)
+}
+
+// window returns the window of the key for the span, creating it if needed.
+// For session windows, all the windows overlapping the span are merged.
+func (agg *Aggregate) window(key string, span Span) *window {
+	windows := agg.windows[key]
+	if !agg.merging {
+		for _, w := range windows {
+			if w.span.equal(span) {
+				return w
+			}
+		}
+		w := &window{key: key, span: span, acc: agg.Init()}
+		agg.windows[key] = append(windows, w)
+		return w
+	}
+
+	merged := &window{key: key, span: span, acc: agg.Init()}
+	var rest []*window
+	for _, w := range windows {
+		if !w.span.overlaps(merged.span) {
+			rest = append(rest, w)
+			continue
+		}
+		merged.span = merged.span.union(w.span)
+		merged.acc = agg.Merge(merged.acc, w.acc)
+		merged.count += w.count
+		merged.emitted = merged.emitted || w.emitted
+		merged.acks = append(merged.acks, w.acks...)
+	}
+	agg.windows[key] = append(rest, merged)
+	return merged
+}
+
+// fire emits the windows that are closed and have messages that were not
+// emitted yet, and purges the windows that are past the allowed lateness.
+func (agg *Aggregate) fire(ctx context.Context, out chan<- fusion.Msg) {
+	var closed []*window
+	open := 0
+	for key, windows := range agg.windows {
+		var retained []*window
+		for _, w := range windows {
+			if !w.span.End.After(agg.watermark) && len(w.acks) > 0 {
+				closed = append(closed, w)
+			}
+			if !agg.expired(w.span) {
+				retained = append(retained, w)
+			}
+		}
+
+		if len(retained) == 0 {
+			delete(agg.windows, key)
+		} else {
+			agg.windows[key] = retained
+			open += len(retained)
+		}
+	}
+	agg.metrics.Gauge("fusion_window_retained", float64(open), nil)
+
+	sort.Slice(closed, func(i, j int) bool {
+		if !closed[i].span.End.Equal(closed[j].span.End) {
+			return closed[i].span.End.Before(closed[j].span.End)
+		}
+		return closed[i].key < closed[j].key
+	})
+	for _, w := range closed {
+		agg.emit(ctx, w, out)
+	}
+}
+
+func (agg *Aggregate) emit(ctx context.Context, w *window, out chan<- fusion.Msg) {
+	res := Result{
+		Key:    w.key,
+		Window: w.span,
+		Value:  w.acc,
+		Count:  w.count,
+		Update: w.emitted,
+	}
+	acks := w.acks
+	w.acks, w.emitted = nil, true
+
+	ackAll := func(err error) {
+		for _, ack := range acks {
+			ack(err)
+		}
+	}
+
+	val, err := agg.Encode(res)
+	if err != nil {
+		agg.log.Warnf("failed to encode result of window %s for key '%s': %v", res.Window, res.Key, err)
+		ackAll(fusion.Fail)
+		return
+	}
+
+	once := &sync.Once{}
+	msg := fusion.Msg{
+		Key: []byte(res.Key),
+		Val: val,
+		Attribs: map[string]string{
+			"window_start":  res.Window.Start.Format(time.RFC3339Nano),
+			"window_end":    res.Window.End.Format(time.RFC3339Nano),
+			"window_count":  strconv.Itoa(res.Count),
+			"window_update": strconv.FormatBool(res.Update),
+		},
+		Ack: func(err error) { once.Do(func() { ackAll(err) }) },
+	}
+
+	agg.metrics.Count("fusion_window_emitted_total", 1, map[string]string{
+		"update": strconv.FormatBool(res.Update),
+	})
+	select {
+	case <-ctx.Done():
+		msg.Ack(fusion.Retry)
+	case out <- msg:
+	}
+}
+
+// abandon nAcks all the messages in the windows that were not emitted.
+func (agg *Aggregate) abandon() {
+	for _, windows := range agg.windows {
+		for _, w := range windows {
+			for _, ack := range w.acks {
+				ack(fusion.Retry)
+			}
+			w.acks = nil
+		}
+	}
+}
+
+// expired returns true if the window is past the allowed lateness.
+func (agg *Aggregate) expired(span Span) bool {
+	return !span.End.Add(agg.AllowedLateness).After(agg.watermark)
+}
+
+func (agg *Aggregate) init(ctx context.Context) error {
+	if agg.Windows == nil {
+		return errors.New("windows assigner must be set")
+	}
+	_, agg.merging = agg.Windows.(session)
+
+	if agg.Init == nil && agg.Add == nil && agg.Merge == nil {
+		agg.Init = func() interface{} { return 0 }
+		agg.Add = func(acc interface{}, _ fusion.Msg) interface{} { return acc.(int) + 1 }
+		agg.Merge = func(a, b interface{}) interface{} { return a.(int) + b.(int) }
+	}
+	if agg.Add == nil {
+		return errors.New("add must be set")
+	} else if agg.merging && agg.Merge == nil {
+		return errors.New("merge must be set for session windows")
+	}
+	if agg.Init == nil {
+		agg.Init = func() interface{} { return nil }
+	}
+
+	if agg.KeyFunc == nil {
+		agg.KeyFunc = func(msg fusion.Msg) string { return string(msg.Key) }
+	}
+	if agg.Encode == nil {
+		agg.Encode = func(res Result) ([]byte, error) { return json.Marshal(res.Value) }
+	}
+	if agg.LateAck == nil {
+		agg.LateAck = fusion.Skip
+	}
+	if agg.TickInterval <= 0 {
+		agg.TickInterval = 1 * time.Second
+	}
+
+	agg.log = fusion.LogFrom(ctx)
+	agg.metrics = fusion.MetricsFrom(ctx)
+	agg.watermark = time.Time{}
+	agg.maxEvent = time.Time{}
+	agg.windows = map[string][]*window{}
+	return nil
+}
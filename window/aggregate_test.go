@@ -0,0 +1,247 @@
+package window_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/window"
+)
+
+func TestAggregate_Run(t *testing.T) {
+	t.Parallel()
+
+	t.Run("NoWindows", func(t *testing.T) {
+		agg := &window.Aggregate{}
+		assert.Error(t, agg.Run(context.Background(), events(nil)))
+	})
+
+	t.Run("SessionWithoutMerge", func(t *testing.T) {
+		agg := &window.Aggregate{
+			Windows: window.Session(time.Minute),
+			Add:     func(acc interface{}, _ fusion.Msg) interface{} { return acc },
+		}
+		assert.Error(t, agg.Run(context.Background(), events(nil)))
+	})
+
+	t.Run("Tumbling", func(t *testing.T) {
+		acks := &ackLog{}
+		sink := &resultSink{}
+		agg := &window.Aggregate{
+			Windows:   window.Tumbling(time.Minute),
+			EventTime: window.AttribTime("ts", ""),
+			Sink:      sink,
+		}
+
+		err := agg.Run(context.Background(), events(acks,
+			"a@10:00:10", "b@10:00:20", "a@10:00:50", "a@10:01:10", "a@10:02:30", "b@bad",
+		))
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"a [10:00:00, 10:01:00) = 2",
+			"b [10:00:00, 10:01:00) = 1",
+			"a [10:01:00, 10:02:00) = 1",
+			"a [10:02:00, 10:03:00) = 1",
+		}, sink.results)
+		assert.Equal(t, map[string]error{
+			"a@10:00:10": nil, "b@10:00:20": nil, "a@10:00:50": nil,
+			"a@10:01:10": nil, "a@10:02:30": nil, "b@bad": fusion.Fail,
+		}, acks.get())
+	})
+
+	t.Run("Hopping", func(t *testing.T) {
+		acks := &ackLog{}
+		sink := &resultSink{err: fusion.Retry}
+		agg := &window.Aggregate{
+			Windows:   window.Hopping(2*time.Minute, time.Minute),
+			EventTime: window.AttribTime("ts", ""),
+			Sink:      sink,
+		}
+
+		err := agg.Run(context.Background(), events(acks, "a@10:00:10", "a@10:01:10"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"a [09:59:00, 10:01:00) = 1",
+			"a [10:00:00, 10:02:00) = 2",
+			"a [10:01:00, 10:03:00) = 1",
+		}, sink.results)
+		assert.Equal(t, map[string]error{
+			"a@10:00:10": fusion.Retry, "a@10:01:10": fusion.Retry,
+		}, acks.get())
+	})
+
+	t.Run("Lateness", func(t *testing.T) {
+		acks := &ackLog{}
+		sink := &resultSink{}
+		agg := &window.Aggregate{
+			Windows:         window.Tumbling(time.Minute),
+			EventTime:       window.AttribTime("ts", ""),
+			MaxOutOfOrder:   10 * time.Second,
+			AllowedLateness: time.Minute,
+			Sink:            sink,
+		}
+
+		err := agg.Run(context.Background(), events(acks,
+			"a@10:00:10",
+			"a@10:01:05", // out-of-order window, [10:00, 10:01) is still open.
+			"a@10:00:40",
+			"a@10:01:10", // closes [10:00, 10:01).
+			"a@10:00:45", // late, but within allowed lateness.
+			"a@10:02:30", // expires [10:00, 10:01).
+			"a@10:00:55", // too late.
+		))
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"a [10:00:00, 10:01:00) = 2",
+			"a [10:00:00, 10:01:00) = 3 (update)",
+			"a [10:01:00, 10:02:00) = 2",
+			"a [10:02:00, 10:03:00) = 1",
+		}, sink.results)
+		assert.Equal(t, fusion.Skip, acks.get()["a@10:00:55"])
+		assert.NoError(t, acks.get()["a@10:00:45"])
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		sink := &resultSink{}
+		agg := &window.Aggregate{
+			Windows:       window.Session(time.Minute),
+			EventTime:     window.AttribTime("ts", ""),
+			MaxOutOfOrder: time.Minute,
+			Init:          func() interface{} { return "" },
+			Add: func(acc interface{}, msg fusion.Msg) interface{} {
+				return acc.(string) + string(msg.Val)
+			},
+			Merge: func(a, b interface{}) interface{} { return a.(string) + b.(string) },
+			Encode: func(res window.Result) ([]byte, error) {
+				return []byte(res.Value.(string)), nil
+			},
+			Sink: sink,
+		}
+
+		err := agg.Run(context.Background(), events(nil,
+			"a@10:00:00", "a@10:01:30", "b@10:00:30", "a@10:00:45", "a@10:03:00",
+		))
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"b [10:00:30, 10:01:30) = x",
+			"a [10:00:00, 10:02:30) = xxx",
+			"a [10:03:00, 10:04:00) = x",
+		}, sink.results)
+	})
+
+	t.Run("ProcessingTime", func(t *testing.T) {
+		sink := &resultSink{}
+		agg := &window.Aggregate{
+			Windows:      window.Tumbling(50 * time.Millisecond),
+			TickInterval: 10 * time.Millisecond,
+			Sink:         sink,
+		}
+
+		stream := make(chan fusion.Msg, 2)
+		stream <- fusion.Msg{Key: []byte("a"), Ack: func(_ error) {}}
+		stream <- fusion.Msg{Key: []byte("a"), Ack: func(_ error) {}}
+
+		done := make(chan error, 1)
+		go func() { done <- agg.Run(context.Background(), stream) }()
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Len(t, sink.get(), 1)
+		close(stream)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		acks := &ackLog{}
+		agg := &window.Aggregate{Windows: window.Tumbling(time.Hour)}
+
+		stream := make(chan fusion.Msg, 1)
+		stream <- fusion.Msg{Key: []byte("a"), Ack: acks.ackAs("a")}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		require.NoError(t, agg.Run(ctx, stream))
+		assert.Equal(t, map[string]error{"a": fusion.Retry}, acks.get())
+	})
+}
+
+// events returns a stream of messages for events of the form "key@hh:mm:ss".
+// Each message has Val set to "x".
+func events(acks *ackLog, evs ...string) <-chan fusion.Msg {
+	ch := make(chan fusion.Msg, len(evs))
+	for _, ev := range evs {
+		parts := strings.SplitN(ev, "@", 2)
+		ack := func(_ error) {}
+		if acks != nil {
+			ack = acks.ackAs(ev)
+		}
+		ch <- fusion.Msg{
+			Key:     []byte(parts[0]),
+			Val:     []byte("x"),
+			Attribs: map[string]string{"ts": "2020-01-01T" + parts[1] + "Z"},
+			Ack:     ack,
+		}
+	}
+	close(ch)
+	return ch
+}
+
+type ackLog struct {
+	mu   sync.Mutex
+	acks map[string]error
+}
+
+func (al *ackLog) ackAs(val string) func(err error) {
+	return func(err error) {
+		al.mu.Lock()
+		defer al.mu.Unlock()
+		if al.acks == nil {
+			al.acks = map[string]error{}
+		}
+		al.acks[val] = err
+	}
+}
+
+func (al *ackLog) get() map[string]error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.acks
+}
+
+// resultSink records the results in "key [start, end) = val" form and acks
+// them with err.
+type resultSink struct {
+	err     error
+	mu      sync.Mutex
+	results []string
+}
+
+func (rs *resultSink) Run(_ context.Context, results <-chan fusion.Msg) error {
+	for res := range results {
+		start, _ := time.Parse(time.RFC3339Nano, res.Attribs["window_start"])
+		end, _ := time.Parse(time.RFC3339Nano, res.Attribs["window_end"])
+
+		line := fmt.Sprintf("%s [%s, %s) = %s", res.Key, start.Format("15:04:05"), end.Format("15:04:05"), res.Val)
+		if res.Attribs["window_update"] == "true" {
+			line += " (update)"
+		}
+
+		rs.mu.Lock()
+		rs.results = append(rs.results, line)
+		rs.mu.Unlock()
+		res.Ack(rs.err)
+	}
+	return nil
+}
+
+func (rs *resultSink) get() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]string(nil), rs.results...)
+}
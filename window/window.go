@@ -0,0 +1,118 @@
+// Package window provides a fusion Proc for aggregating messages per key over
+// tumbling, hopping and session windows of processing time or event time.
+package window
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spy16/fusion"
+)
+
+// Span represents the time range [Start, End) of a window.
+type Span struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (s Span) String() string {
+	return fmt.Sprintf("[%s, %s)", s.Start.Format(time.RFC3339Nano), s.End.Format(time.RFC3339Nano))
+}
+
+func (s Span) equal(other Span) bool {
+	return s.Start.Equal(other.Start) && s.End.Equal(other.End)
+}
+
+func (s Span) overlaps(other Span) bool {
+	return s.Start.Before(other.End) && other.Start.Before(s.End)
+}
+
+func (s Span) union(other Span) Span {
+	u := s
+	if other.Start.Before(u.Start) {
+		u.Start = other.Start
+	}
+	if other.End.After(u.End) {
+		u.End = other.End
+	}
+	return u
+}
+
+// Assigner decides the windows a message belongs to.
+type Assigner interface {
+	// Assign should return the windows that contain the time t.
+	Assign(t time.Time) []Span
+}
+
+// Tumbling returns an Assigner for fixed size, non-overlapping windows that
+// are aligned to the epoch.
+func Tumbling(size time.Duration) Assigner {
+	return Hopping(size, size)
+}
+
+// Hopping returns an Assigner for fixed size windows that start every hop.
+// Windows overlap when hop is less than size, in which case a message
+// belongs to multiple windows.
+func Hopping(size, hop time.Duration) Assigner {
+	if size <= 0 || hop <= 0 {
+		panic("window size and hop must be positive")
+	}
+	return hopping{size: size, hop: hop}
+}
+
+// Session returns an Assigner for windows that group messages of a key that
+// are not more than gap apart. Session windows are merged as messages arrive
+// and hence require Aggregate.Merge to be set.
+func Session(gap time.Duration) Assigner {
+	if gap <= 0 {
+		panic("session gap must be positive")
+	}
+	return session{gap: gap}
+}
+
+// AttribTime returns an event time extractor that parses the value of the
+// given attribute with the layout. If layout is empty, the value is parsed
+// as RFC3339 timestamp or as milliseconds since epoch.
+func AttribTime(name, layout string) func(msg fusion.Msg) (time.Time, error) {
+	return func(msg fusion.Msg) (time.Time, error) {
+		v, found := msg.Attribs[name]
+		if !found {
+			return time.Time{}, fmt.Errorf("attribute '%s' not found", name)
+		}
+
+		if layout != "" {
+			return time.Parse(layout, v)
+		} else if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond)), nil
+		}
+		return time.Parse(time.RFC3339Nano, v)
+	}
+}
+
+type hopping struct {
+	size time.Duration
+	hop  time.Duration
+}
+
+func (h hopping) Assign(t time.Time) []Span {
+	// start of the last window that contains t.
+	last := t.Add(-time.Duration(t.UnixNano() % int64(h.hop)))
+	if t.UnixNano() < 0 && last.After(t) {
+		last = last.Add(-h.hop)
+	}
+
+	var spans []Span
+	for start := last; start.Add(h.size).After(t); start = start.Add(-h.hop) {
+		spans = append([]Span{{Start: start, End: start.Add(h.size)}}, spans...)
+	}
+	return spans
+}
+
+type session struct {
+	gap time.Duration
+}
+
+func (s session) Assign(t time.Time) []Span {
+	return []Span{{Start: t, End: t.Add(s.gap)}}
+}
@@ -0,0 +1,76 @@
+package window_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/fusion"
+	"github.com/spy16/fusion/window"
+)
+
+func TestTumbling(t *testing.T) {
+	t.Parallel()
+
+	spans := window.Tumbling(time.Minute).Assign(ts("10:01:30"))
+	assert.Equal(t, []window.Span{{Start: ts("10:01:00"), End: ts("10:02:00")}}, spans)
+
+	spans = window.Tumbling(time.Minute).Assign(ts("10:02:00"))
+	assert.Equal(t, []window.Span{{Start: ts("10:02:00"), End: ts("10:03:00")}}, spans)
+}
+
+func TestHopping(t *testing.T) {
+	t.Parallel()
+
+	spans := window.Hopping(3*time.Minute, time.Minute).Assign(ts("10:01:30"))
+	assert.Equal(t, []window.Span{
+		{Start: ts("09:59:00"), End: ts("10:02:00")},
+		{Start: ts("10:00:00"), End: ts("10:03:00")},
+		{Start: ts("10:01:00"), End: ts("10:04:00")},
+	}, spans)
+
+	// gaps between windows when hop is larger than size.
+	assert.Empty(t, window.Hopping(time.Minute, 2*time.Minute).Assign(ts("10:01:30")))
+}
+
+func TestSession(t *testing.T) {
+	t.Parallel()
+
+	spans := window.Session(time.Minute).Assign(ts("10:01:30"))
+	assert.Equal(t, []window.Span{{Start: ts("10:01:30"), End: ts("10:02:30")}}, spans)
+}
+
+func TestAttribTime(t *testing.T) {
+	t.Parallel()
+
+	msg := func(v string) fusion.Msg { return fusion.Msg{Attribs: map[string]string{"ts": v}} }
+
+	got, err := window.AttribTime("ts", "")(msg("2020-01-01T10:01:30Z"))
+	require.NoError(t, err)
+	assert.True(t, ts("10:01:30").Equal(got))
+
+	got, err = window.AttribTime("ts", "")(msg("1577872890000"))
+	require.NoError(t, err)
+	assert.True(t, ts("10:01:30").Equal(got))
+
+	got, err = window.AttribTime("ts", "2006-01-02 15:04:05")(msg("2020-01-01 10:01:30"))
+	require.NoError(t, err)
+	assert.True(t, ts("10:01:30").Equal(got))
+
+	_, err = window.AttribTime("ts", "")(fusion.Msg{})
+	assert.Error(t, err)
+
+	_, err = window.AttribTime("ts", "")(msg("yesterday"))
+	assert.Error(t, err)
+}
+
+// ts returns the time of the day on 2020-01-01 in UTC.
+func ts(clock string) time.Time {
+	t, err := time.Parse(time.RFC3339, "2020-01-01T"+clock+"Z")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}